@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mkg20001/give-me-dns/lib"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const usage = `Usage:
+  give-me-dns <config>                  Run the server
+  give-me-dns export [-zone] [-secrets] [-url url] <config>
+                                        Write all entries to stdout as JSON lines, or as zone file with -zone.
+                                        The TSIG keys of the entries are left out unless -secrets is given
+  give-me-dns import <config>           Read entries in the format of export from stdin
+  give-me-dns backup [-url url] <config> <file>
+                                        Save a snapshot of the store of the running server, usable as its file
+`
+
+// openStore opens the store of the config file for the commands, without starting the server
+func openStore(path string) (*lib.Config, *lib.Store, func() error, error) {
+	config, err := lib.ReadConfig(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	err, closeStore, store := lib.ProvideStore(&config.Store, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return config, store, closeStore, nil
+}
+
+// readStore opens the store of config for reading, without changing it. If the running server holds its file,
+// a snapshot fetched from the server at url (see Backup) is read instead.
+func readStore(config *lib.Config, url string) (*lib.Store, func() error, error) {
+	err, closeStore, store := lib.ProvideReadOnlyStore(&config.Store)
+	if !errors.Is(err, lib.ErrInUse) || config.HTTP.AdminToken == "" {
+		return store, closeStore, err
+	}
+
+	snapshot, err := os.CreateTemp("", "give-me-dns-snapshot")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer snapshot.Close()
+	remove := func() {
+		_ = os.Remove(snapshot.Name())
+	}
+
+	_, err = fetchBackup(config, url, snapshot)
+	if err != nil {
+		remove()
+		return nil, nil, err
+	}
+
+	storeConfig := config.Store
+	storeConfig.File = snapshot.Name()
+	err, closeStore, store = lib.ProvideReadOnlyStore(&storeConfig)
+	if err != nil {
+		remove()
+		return nil, nil, err
+	}
+
+	return store, func() error {
+		defer remove()
+		return closeStore()
+	}, nil
+}
+
+func Export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	zone := flags.Bool("zone", false, "write an RFC 1035 zone file instead of JSON lines")
+	secrets := flags.Bool("secrets", false, "include the TSIG secrets of the entries, which are stored in plain")
+	url := flags.String("url", "", "address of the server to get a snapshot from while it runs, defaults to the http address of the config")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	config, err := lib.ReadConfig(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	store, closeStore, err := readStore(config, *url)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	if *zone {
+		return lib.ExportZone(os.Stdout, &config.DNS, store)
+	}
+
+	return store.Export(os.Stdout, *secrets)
+}
+
+func Import(args []string) error {
+	if len(args) != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	_, store, closeStore, err := openStore(args[0])
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	imported, err := store.Import(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Imported %d entries\n", imported)
+
+	return nil
+}
+
+func Backup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	url := flags.String("url", "", "address of the server, defaults to the http address of the config")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	config, err := lib.ReadConfig(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	// the snapshot only replaces file once it is complete
+	tmp := flags.Arg(1) + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	n, err := fetchBackup(config, *url, file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Saved backup of %d bytes to %s\n", n, flags.Arg(1))
+
+	return nil
+}
+
+// fetchBackup writes a snapshot of the store of the server at url, or the http address of config if empty, to w
+func fetchBackup(config *lib.Config, url string, w io.Writer) (int64, error) {
+	if url == "" {
+		address := config.HTTP.Address
+		if address == "" || address == "0.0.0.0" || address == "::" {
+			address = "localhost"
+		}
+		url = "http://" + net.JoinHostPort(address, strconv.Itoa(int(config.HTTP.Port)))
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(url, "/")+"/admin/backup", nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+config.HTTP.AdminToken)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("backup failed: %s", res.Status)
+	}
+
+	return io.Copy(w, res.Body)
+}
@@ -21,6 +21,7 @@ func Init(config *lib.Config, _ctx context.Context) error {
 		Debug: true,
 	})
 	if err != nil {
+		cancel(err)
 		return err
 	}
 	defer sentry.Flush(10 * time.Second)
@@ -32,6 +33,7 @@ func Init(config *lib.Config, _ctx context.Context) error {
 	if config.Provider.PWordlistID.Enable {
 		wordlist, err := idprov.ProvideWordlistID()
 		if err != nil {
+			cancel(err)
 			return err
 		}
 		idProv = append(idProv, wordlist)
@@ -48,10 +50,19 @@ func Init(config *lib.Config, _ctx context.Context) error {
 		return err
 	}
 
+	limiter, err := lib.ProvideRateLimiter(&config.RateLimit, store)
+	if err != nil {
+		cancel(err)
+		_ = cleanStore()
+		return err
+	}
+
 	go func() {
 		lib.ProvideDNS(&config.DNS, store, ctx, errChan)
-		lib.ProvideNet(&config.Net, store, ctx, errChan)
-		lib.ProvideHTTP(&config.HTTP, store, ctx, errChan)
+		lib.ProvideNotify(&config.DNS, store, ctx, errChan)
+		lib.ProvideNet(&config.Net, store, limiter, ctx, errChan)
+		lib.ProvideHTTP(&config.HTTP, store, limiter, ctx, errChan)
+		lib.ProvideWebhooks(config.Webhooks, store, ctx, errChan)
 	}()
 
 	go func() {
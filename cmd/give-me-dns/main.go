@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"github.com/mkg20001/give-me-dns/lib"
 	"log"
 	"os"
@@ -11,6 +12,32 @@ import (
 )
 
 func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "export":
+		err := Export(os.Args[2:])
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	case "import":
+		err := Import(os.Args[2:])
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	case "backup":
+		err := Backup(os.Args[2:])
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	var wg2 sync.WaitGroup
 	wg := &wg2
 
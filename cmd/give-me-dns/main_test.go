@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"github.com/google/uuid"
 	"github.com/miekg/dns"
 	"github.com/mkg20001/give-me-dns/lib"
@@ -9,7 +12,10 @@ import (
 	"github.com/stretchr/testify/suite"
 	"io"
 	"net"
+	"net/http"
+	"net/url"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 )
@@ -27,17 +33,47 @@ func (s *GDNSTestSuite) SetupSuite() {
 				Domain: "give-me-dns.net",
 				File:   "/tmp/" + uuid.Must(uuid.NewUUID()).String(),
 				TTL:    48 * time.Hour,
+
+				MaxLifetime: 72 * time.Hour,
 			},
 			DNS: lib.DNSConfig{
 				Port:  5354,
 				MNAME: "example.example.org.",
 				NS:    []string{"ns1.give-me-dns.net.", "ns2.give-me-dns.net."},
+				Transfer: lib.TransferConfig{
+					Allow:    []string{"::1"},
+					TSIGKeys: map[string]string{"xfr": xfrSecret},
+				},
+				Embedded: lib.EmbeddedConfig{
+					Enable: true,
+					Allow:  []string{"2001:db8::/32", "192.0.2.0/24"},
+				},
+				Reverse: []lib.ReverseZoneConfig{
+					{Zone: "127.in-addr.arpa"},
+				},
 			},
 			Net: lib.NetConfig{
 				Port: 9999,
 			},
 			HTTP: lib.HTTPConfig{
-				Port: 8053,
+				Port:           8053,
+				AdminToken:     "admin",
+				TrustedProxies: []string{"127.0.0.1"},
+			},
+			RateLimit: lib.RateLimitConfig{
+				Rules: []lib.RateLimitRule{
+					{
+						Prefix4:  32,
+						Prefix6:  128,
+						Requests: 10,
+						Interval: time.Minute,
+					},
+					{
+						Prefix4:    24,
+						Prefix6:    56,
+						MaxEntries: 10,
+					},
+				},
 			},
 			Provider: lib.ProviderConfig{
 				PWordlistID: lib.PWordlistIDConfig{
@@ -56,6 +92,8 @@ func (s *GDNSTestSuite) SetupSuite() {
 	s.cancel = cancel
 }
 
+var xfrSecret = "c2VjcmV0LXNlY3JldC1zZWNyZXQtc2VjcmV0"
+
 var re = regexp.MustCompile(`(?m)Address: ::1\nDNS Name: ([a-z0-9]{5}\.give-me-dns\.net)\nValid for 48h0m0s\nExpires .+\n`)
 
 func (s *GDNSTestSuite) TestEntryAndDNS() {
@@ -82,7 +120,7 @@ func (s *GDNSTestSuite) TestEntryAndDNS() {
 	m1 := new(dns.Msg)
 	m1.Id = dns.Id()
 	m1.Question = make([]dns.Question, 1)
-	m1.Question[0] = dns.Question{address, dns.TypeAAAA, dns.ClassINET}
+	m1.Question[0] = dns.Question{Name: address, Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}
 
 	in, err := dns.Exchange(m1, "[::1]:5354")
 	if err != nil {
@@ -101,7 +139,735 @@ func (s *GDNSTestSuite) TestEntryAndDNS() {
 		panic(err)
 	}
 
-	s.Equal(res, res2)
+	// re-registering keeps the name, only the expiry moves
+	s.Equal(reName.FindSubmatch(res), reName.FindSubmatch(res2))
+}
+
+var re4 = regexp.MustCompile(`(?m)Address: 127\.0\.0\.1\nDNS Name: ([a-z0-9]{5}\.give-me-dns\.net)\nValid for 48h0m0s\nExpires .+\n`)
+
+func (s *GDNSTestSuite) TestEntryAndDNSv4() {
+	time.Sleep(1 * time.Second)
+
+	c, err := net.Dial("tcp", "127.0.0.1:9999")
+	if err != nil {
+		panic(err)
+	}
+
+	res, err := io.ReadAll(c)
+	if err != nil {
+		panic(err)
+	}
+
+	submatch := re4.FindSubmatch(res)
+
+	assert.Condition(s.T(), func() (success bool) {
+		return submatch != nil
+	}, "Message not formatted well")
+
+	address := string(submatch[1]) + "."
+
+	m1 := new(dns.Msg)
+	m1.Id = dns.Id()
+	m1.Question = make([]dns.Question, 1)
+	m1.Question[0] = dns.Question{Name: address, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	in, err := dns.Exchange(m1, "127.0.0.1:5354")
+	if err != nil {
+		panic(err)
+	}
+
+	s.Equal(address+"\t172800\tIN\tA\t127.0.0.1", in.Answer[0].String())
+
+	m2 := new(dns.Msg)
+	m2.Id = dns.Id()
+	m2.Question = make([]dns.Question, 1)
+	m2.Question[0] = dns.Question{Name: address, Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}
+
+	in, err = dns.Exchange(m2, "127.0.0.1:5354")
+	if err != nil {
+		panic(err)
+	}
+
+	s.Empty(in.Answer)
+}
+
+// command sends cmd to the TCP frontend from the local address laddr and returns the response
+func command(laddr string, cmd string) string {
+	ip := net.ParseIP(laddr)
+	raddr := "[::1]:9999"
+	if ip.To4() != nil {
+		raddr = "127.0.0.1:9999"
+	}
+
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: ip}}
+	c, err := dialer.Dial("tcp", raddr)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = c.Write([]byte(cmd + "\n"))
+	if err != nil {
+		panic(err)
+	}
+
+	res, err := io.ReadAll(c)
+	if err != nil {
+		panic(err)
+	}
+
+	return string(res)
+}
+
+func query(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.Id = dns.Id()
+	m.Question = []dns.Question{{Name: name, Qtype: qtype, Qclass: dns.ClassINET}}
+
+	in, err := dns.Exchange(m, "[::1]:5354")
+	if err != nil {
+		panic(err)
+	}
+
+	return in
+}
+
+var reName = regexp.MustCompile(`(?m)^DNS Name: (.+)$`)
+var reLink = regexp.MustCompile(`(?m)^Link code: (.+)$`)
+var reToken = regexp.MustCompile(`(?m)^Token: (.+)$`)
+
+func (s *GDNSTestSuite) TestLink() {
+	time.Sleep(1 * time.Second)
+
+	res := command("::1", "ADD")
+	name := reName.FindStringSubmatch(res)
+	s.NotNil(name, res)
+
+	res = command("::1", "LINK")
+	code := reLink.FindStringSubmatch(res)
+	s.NotNil(code, res)
+
+	res = command("127.0.0.2", "LINK "+code[1])
+	s.Contains(res, "Address: ::1\nAddress: 127.0.0.2\nDNS Name: "+name[1]+"\n")
+
+	in := query(name[1]+".", dns.TypeA)
+	s.Equal(name[1]+".\t172800\tIN\tA\t127.0.0.2", in.Answer[0].String())
+
+	in = query(name[1]+".", dns.TypeAAAA)
+	s.Equal(name[1]+".\t172800\tIN\tAAAA\t::1", in.Answer[0].String())
+
+	s.Equal("Invalid or expired link code.\n", command("127.0.0.3", "LINK "+code[1]))
+}
+
+func (s *GDNSTestSuite) TestRenew() {
+	time.Sleep(1 * time.Second)
+
+	res := command("127.0.0.4", "ADD")
+	name := reName.FindStringSubmatch(res)
+	token := reToken.FindStringSubmatch(res)
+	s.NotNil(name, res)
+	s.NotNil(token, res)
+
+	res = command("127.0.0.4", "RENEW")
+	s.Contains(res, "DNS Name: "+name[1]+"\nValid for 48h0m0s\n")
+	s.Contains(res, "Renewable until ")
+
+	s.Equal("Not allowed to renew this DNS name, use its token or one of its addresses.\n", command("127.0.0.5", "RENEW "+name[1]))
+	s.Equal("No DNS name registered for this address.\n", command("127.0.0.5", "RENEW"))
+	s.Equal("No such DNS name.\n", command("127.0.0.5", "RENEW does-not-exist"))
+
+	req, err := http.NewRequest("PUT", "http://127.0.0.1:8053/json", strings.NewReader(`{"name":"`+name[1]+`"}`))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("X-Forwarded-For", "127.0.0.4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+	s.Equal(http.StatusOK, resp.StatusCode)
+	s.Contains(string(body), `"dns_name":"`+name[1]+`"`)
+
+	// from other addresses the token is needed, addresses forwarded by untrusted clients don't count
+	renew := func(body string) int {
+		req, err := http.NewRequest("PUT", "http://[::1]:8053/json", strings.NewReader(body))
+		if err != nil {
+			panic(err)
+		}
+		req.Header.Set("X-Forwarded-For", "127.0.0.4")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+	s.Equal(http.StatusForbidden, renew(`{"name":"`+name[1]+`"}`))
+	s.Equal(http.StatusOK, renew(`{"name":"`+name[1]+`","token":"`+token[1]+`"}`))
+
+	resp, err = http.PostForm("http://[::1]:8053/", url.Values{"action": {"renew"}, "name": {name[1]}, "token": {token[1]}})
+	if err != nil {
+		panic(err)
+	}
+	resp.Body.Close()
+	s.Equal(http.StatusOK, resp.StatusCode)
+}
+
+func (s *GDNSTestSuite) TestRelease() {
+	time.Sleep(1 * time.Second)
+
+	res := command("127.0.0.6", "ADD")
+	name := reName.FindStringSubmatch(res)
+	s.NotNil(name, res)
+
+	s.Equal("Not allowed to release this DNS name, use its token or one of its addresses.\n", command("127.0.0.7", "RELEASE "+name[1]))
+
+	// addresses forwarded by untrusted clients don't count
+	req, err := http.NewRequest("DELETE", "http://[::1]:8053/json", strings.NewReader(`{"name":"`+name[1]+`"}`))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("X-Forwarded-For", "127.0.0.6")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	resp.Body.Close()
+	s.Equal(http.StatusForbidden, resp.StatusCode)
+
+	resp, err = http.PostForm("http://[::1]:8053/", url.Values{"action": {"release"}, "name": {name[1]}, "token": {"wrong"}})
+	if err != nil {
+		panic(err)
+	}
+	resp.Body.Close()
+	s.Equal(http.StatusForbidden, resp.StatusCode)
+
+	// other sites can't submit the form for the visitor
+	req, err = http.NewRequest("POST", "http://127.0.0.1:8053/", strings.NewReader("action=release"))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Forwarded-For", "127.0.0.6")
+	req.Header.Set("Origin", "https://example.org")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	resp.Body.Close()
+	s.Equal(http.StatusForbidden, resp.StatusCode)
+
+	s.Equal("Released "+name[1]+"\n", command("127.0.0.6", "RELEASE"))
+
+	in := query(name[1]+".", dns.TypeA)
+	s.Empty(in.Answer)
+	s.Equal(dns.RcodeNameError, in.Rcode)
+
+	s.Equal("No DNS name registered for this address.\n", command("127.0.0.6", "RELEASE"))
+}
+
+func (s *GDNSTestSuite) TestToken() {
+	time.Sleep(1 * time.Second)
+
+	res := command("127.0.0.8", "ADD")
+	name := reName.FindStringSubmatch(res)
+	token := reToken.FindStringSubmatch(res)
+	s.NotNil(name, res)
+	s.NotNil(token, res)
+
+	// the token is only shown when it is issued
+	s.NotContains(command("127.0.0.8", "ADD"), "Token: ")
+
+	s.Equal("Not allowed to update this DNS name, use its token or one of its addresses.\n", command("127.0.0.9", "UPDATE "+name[1]+" wrong"))
+
+	res = command("127.0.0.9", "UPDATE "+name[1]+" "+token[1])
+	s.Contains(res, "Address: 127.0.0.9\nDNS Name: "+name[1]+"\n")
+
+	in := query(name[1]+".", dns.TypeA)
+	s.Equal(name[1]+".\t172800\tIN\tA\t127.0.0.9", in.Answer[0].String())
+
+	s.Contains(command("127.0.0.10", "RENEW "+name[1]+" "+token[1]), "DNS Name: "+name[1]+"\n")
+
+	res = command("127.0.0.10", "TOKEN "+name[1]+" "+token[1])
+	newToken := reToken.FindStringSubmatch(res)
+	s.NotNil(newToken, res)
+	s.Equal("Not allowed to release this DNS name, use its token or one of its addresses.\n", command("127.0.0.10", "RELEASE "+name[1]+" "+token[1]))
+	s.Equal("Released "+name[1]+"\n", command("127.0.0.10", "RELEASE "+name[1]+" "+newToken[1]))
+}
+
+func (s *GDNSTestSuite) TestVanityName() {
+	time.Sleep(1 * time.Second)
+
+	res := command("127.0.0.11", "my-vanity")
+	s.Contains(res, "DNS Name: my-vanity.give-me-dns.net\n")
+
+	in := query("my-vanity.give-me-dns.net.", dns.TypeA)
+	s.Equal("my-vanity.give-me-dns.net.\t172800\tIN\tA\t127.0.0.11", in.Answer[0].String())
+
+	res = command("127.0.0.12", "ADD my-vanity")
+	s.Contains(res, "The name my-vanity is not available\n")
+	s.NotContains(res, "DNS Name: my-vanity.give-me-dns.net\n")
+
+	res = command("127.0.0.13", "www")
+	s.Contains(res, "The name www is not available\n")
+
+	s.Equal("Invalid name, use 1-63 letters, digits and hyphens, not starting or ending with a hyphen.\n", command("127.0.0.13", "ADD -bad"))
+}
+
+func (s *GDNSTestSuite) TestRateLimit() {
+	time.Sleep(1 * time.Second)
+
+	for i := 0; i < 10; i++ {
+		s.Contains(command("127.0.2.1", "HELP"), "Commands:\n")
+	}
+	s.Contains(command("127.0.2.1", "HELP"), "Too many requests from 127.0.2.1/32, try again in ")
+
+	// other addresses are not affected
+	s.Contains(command("127.0.2.2", "HELP"), "Commands:\n")
+}
+
+func (s *GDNSTestSuite) TestQuota() {
+	time.Sleep(1 * time.Second)
+
+	for i := 1; i <= 10; i++ {
+		s.Contains(command(fmt.Sprintf("127.0.1.%d", i), "ADD"), "DNS Name: ")
+	}
+	s.Equal("Too many addresses registered from 127.0.1.0/24, at most 10 are allowed.\n", command("127.0.1.11", "ADD"))
+
+	// renewing existing names is still possible
+	s.Contains(command("127.0.1.1", "ADD"), "DNS Name: ")
+}
+
+func (s *GDNSTestSuite) TestHistory() {
+	time.Sleep(1 * time.Second)
+
+	res := command("127.0.0.14", "ADD")
+	name := reName.FindStringSubmatch(res)
+	s.NotNil(name, res)
+	s.Equal("Released "+name[1]+"\n", command("127.0.0.14", "RELEASE"))
+
+	history := func(token string, query string) (int, string) {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:8053/admin/history?"+query, nil)
+		if err != nil {
+			panic(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			panic(err)
+		}
+
+		return resp.StatusCode, string(body)
+	}
+
+	status, _ := history("wrong", "name="+name[1])
+	s.Equal(http.StatusUnauthorized, status)
+
+	status, body := history("admin", "name="+name[1])
+	s.Equal(http.StatusOK, status)
+	s.Regexp(`"action":"registered","name":"`+name[1]+`","addresses":\["127.0.0.14"\],"client":"127.0.0.14","frontend":"tcp"}.*"action":"released"`, body)
+
+	status, body = history("admin", "ip=127.0.0.14/32")
+	s.Equal(http.StatusOK, status)
+	s.Contains(body, `"name":"`+name[1]+`"`)
+
+	status, _ = history("admin", "ip=bad")
+	s.Equal(http.StatusBadRequest, status)
+}
+
+func (s *GDNSTestSuite) TestTransfer() {
+	time.Sleep(1 * time.Second)
+
+	res := command("127.0.0.15", "ADD")
+	name := reName.FindStringSubmatch(res)
+	s.NotNil(name, res)
+
+	transfer := func(addr string, qtype uint16, key string) ([]dns.RR, error) {
+		m := new(dns.Msg)
+		m.SetQuestion("give-me-dns.net.", qtype)
+		if qtype == dns.TypeIXFR {
+			soa := query("give-me-dns.net.", dns.TypeSOA).Answer[0].(*dns.SOA)
+			m.Ns = []dns.RR{soa}
+		}
+
+		tr := new(dns.Transfer)
+		if key != "" {
+			m.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+			tr.TsigSecret = map[string]string{key: xfrSecret}
+		}
+
+		env, err := tr.In(m, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		var rrs []dns.RR
+		for e := range env {
+			if e.Error != nil {
+				return nil, e.Error
+			}
+			rrs = append(rrs, e.RR...)
+		}
+
+		return rrs, nil
+	}
+
+	rrs, err := transfer("[::1]:5354", dns.TypeAXFR, "xfr.")
+	s.NoError(err)
+	s.Equal(dns.TypeSOA, rrs[0].Header().Rrtype)
+	s.Equal(rrs[0].String(), rrs[len(rrs)-1].String())
+	s.Contains(fmt.Sprint(rrs), name[1]+".\t172800\tIN\tA\t127.0.0.15")
+
+	// an up-to-date secondary only gets the SOA
+	rrs, err = transfer("[::1]:5354", dns.TypeIXFR, "xfr.")
+	s.NoError(err)
+	s.Len(rrs, 1)
+
+	_, err = transfer("[::1]:5354", dns.TypeAXFR, "")
+	s.ErrorContains(err, fmt.Sprintf("bad xfr rcode: %d", dns.RcodeRefused))
+
+	_, err = transfer("127.0.0.1:5354", dns.TypeAXFR, "xfr.")
+	s.ErrorContains(err, fmt.Sprintf("bad xfr rcode: %d", dns.RcodeRefused))
+}
+
+var reKey = regexp.MustCompile(`(?m)^TSIG key: hmac-sha256:(.+):(.+)$`)
+
+func (s *GDNSTestSuite) TestUpdate() {
+	time.Sleep(1 * time.Second)
+
+	res := command("127.0.0.16", "ADD")
+	name := reName.FindStringSubmatch(res)
+	s.NotNil(name, res)
+
+	res = command("127.0.0.16", "KEY")
+	key := reKey.FindStringSubmatch(res)
+	s.NotNil(key, res)
+	s.Equal(name[1]+".", key[1])
+
+	update := func(rrs ...string) int {
+		m := new(dns.Msg)
+		m.SetUpdate("give-me-dns.net.")
+		for _, rr := range rrs {
+			parsed, err := dns.NewRR(rr)
+			if err != nil {
+				panic(err)
+			}
+			m.Ns = append(m.Ns, parsed)
+		}
+		m.SetTsig(key[1], dns.HmacSHA256, 300, time.Now().Unix())
+
+		c := &dns.Client{TsigSecret: map[string]string{key[1]: key[2]}}
+		in, _, err := c.Exchange(m, "[::1]:5354")
+		if err != nil {
+			panic(err)
+		}
+
+		return in.Rcode
+	}
+
+	s.Equal(dns.RcodeSuccess, update(name[1]+". 60 IN AAAA 2001:db8::16", name[1]+". 60 IN A 192.0.2.16"))
+
+	in := query(name[1]+".", dns.TypeAAAA)
+	s.Equal(name[1]+".\t172800\tIN\tAAAA\t2001:db8::16", in.Answer[0].String())
+	in = query(name[1]+".", dns.TypeA)
+	s.Equal(name[1]+".\t172800\tIN\tA\t192.0.2.16", in.Answer[0].String())
+
+	// addresses updated from elsewhere are only claimed, their holders don't get the name
+	s.False(jsonInfo("http://127.0.0.1:8053", "192.0.2.16").HasDNS)
+
+	// the key only updates its own name
+	s.Equal(dns.RcodeRefused, update("other.give-me-dns.net. 60 IN A 192.0.2.17"))
+	s.Equal(dns.RcodeRefused, update(name[1]+". 60 IN TXT hello"))
+
+	// nor does it allow transfers
+	m := new(dns.Msg)
+	m.SetQuestion("give-me-dns.net.", dns.TypeAXFR)
+	m.SetTsig(key[1], dns.HmacSHA256, 300, time.Now().Unix())
+	tr := &dns.Transfer{TsigSecret: map[string]string{key[1]: key[2]}}
+	env, err := tr.In(m, "[::1]:5354")
+	s.NoError(err)
+	for e := range env {
+		s.ErrorContains(e.Error, fmt.Sprintf("bad xfr rcode: %d", dns.RcodeRefused))
+	}
+
+	// unsigned updates are refused
+	m = new(dns.Msg)
+	m.SetUpdate("give-me-dns.net.")
+	in, err = dns.Exchange(m, "[::1]:5354")
+	s.NoError(err)
+	s.Equal(dns.RcodeRefused, in.Rcode)
+}
+
+func (s *GDNSTestSuite) TestDynDNS() {
+	time.Sleep(1 * time.Second)
+
+	res := command("127.0.0.17", "ADD")
+	name := reName.FindStringSubmatch(res)
+	token := reToken.FindStringSubmatch(res)
+	s.NotNil(name, res)
+	s.NotNil(token, res)
+
+	update := func(user string, password string, query string) (int, string) {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:8053/nic/update?"+query, nil)
+		if err != nil {
+			panic(err)
+		}
+		req.SetBasicAuth(user, password)
+		req.Header.Set("X-Forwarded-For", "127.0.0.17")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			panic(err)
+		}
+
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := update(name[1], token[1], "hostname="+name[1]+"&myip=192.0.2.17&myipv6=2001:db8::17")
+	s.Equal(http.StatusOK, status)
+	s.Equal("good 192.0.2.17,2001:db8::17\n", body)
+
+	in := query(name[1]+".", dns.TypeA)
+	s.Equal(name[1]+".\t172800\tIN\tA\t192.0.2.17", in.Answer[0].String())
+
+	_, body = update(name[1], token[1], "myip=192.0.2.17")
+	s.Equal("nochg 192.0.2.17\n", body)
+
+	// names have one address of each family
+	status, body = update(name[1], token[1], "myip=192.0.2.18,192.0.2.19")
+	s.Equal(http.StatusBadRequest, status)
+	s.Equal("911\n", body)
+
+	_, body = update(name[1], "wrong", "myip=192.0.2.18")
+	s.Equal("badauth\n", body)
+
+	_, body = update("does-not-exist", token[1], "")
+	s.Equal("nohost\n", body)
+
+	_, body = update(name[1], token[1], "hostname=other.give-me-dns.net")
+	s.Equal("nohost\n", body)
+}
+
+func (s *GDNSTestSuite) TestACME() {
+	time.Sleep(1 * time.Second)
+
+	res := command("127.0.0.18", "ADD")
+	name := reName.FindStringSubmatch(res)
+	token := reToken.FindStringSubmatch(res)
+	s.NotNil(name, res)
+	s.NotNil(token, res)
+
+	post := func(path string, body string, header map[string]string) (int, string) {
+		req, err := http.NewRequest("POST", "http://127.0.0.1:8053"+path, strings.NewReader(body))
+		if err != nil {
+			panic(err)
+		}
+		req.Header.Set("X-Forwarded-For", "127.0.0.18")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			panic(err)
+		}
+
+		return resp.StatusCode, string(b)
+	}
+
+	status, body := post("/register", "", nil)
+	s.Equal(http.StatusCreated, status)
+
+	var account lib.ACMERegistration
+	s.NoError(json.Unmarshal([]byte(body), &account))
+	s.Equal("_acme-challenge."+name[1], account.FullDomain)
+
+	// replacing the account takes the token, the address alone isn't enough
+	status, _ = post("/register", "", nil)
+	s.Equal(http.StatusUnauthorized, status)
+
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte(name[1]+":"+token[1]))
+	status, body = post("/register", "", map[string]string{"Authorization": basic})
+	s.Equal(http.StatusCreated, status)
+	s.NoError(json.Unmarshal([]byte(body), &account))
+
+	txt := "LPsIwTo7o8BoG0-vjCyGQGBWSVIPxI-i_X336eUOQZo"
+	update := `{"subdomain":"` + account.Subdomain + `","txt":"` + txt + `"}`
+	status, body = post("/update", update, map[string]string{"X-Api-User": account.Username, "X-Api-Key": account.Password})
+	s.Equal(http.StatusOK, status)
+	s.JSONEq(`{"txt":"`+txt+`"}`, body)
+
+	status, _ = post("/update", update, map[string]string{"X-Api-User": account.Username, "X-Api-Key": "wrong"})
+	s.Equal(http.StatusUnauthorized, status)
+
+	status, body = post("/update", `{"subdomain":"`+account.Subdomain+`","txt":"short"}`, map[string]string{"X-Api-User": account.Username, "X-Api-Key": account.Password})
+	s.Equal(http.StatusBadRequest, status)
+	s.Contains(body, "bad_txt")
+
+	m := new(dns.Msg)
+	m.SetQuestion(account.FullDomain+".", dns.TypeTXT)
+	m.SetEdns0(4096, true)
+	in, err := dns.Exchange(m, "[::1]:5354")
+	s.NoError(err)
+	s.Equal(account.FullDomain+".\t60\tIN\tTXT\t\""+txt+"\"", in.Answer[0].String())
+	s.Equal(dns.TypeRRSIG, in.Answer[1].Header().Rrtype)
+
+	// the challenge name exists, even without other records
+	in = query(account.FullDomain+".", dns.TypeA)
+	s.Equal(dns.RcodeSuccess, in.Rcode)
+}
+
+func (s *GDNSTestSuite) TestEmbedded() {
+	in := query("2001-db8--1.give-me-dns.net.", dns.TypeAAAA)
+	s.Equal("2001-db8--1.give-me-dns.net.\t172800\tIN\tAAAA\t2001:db8::1", in.Answer[0].String())
+
+	in = query("192-0-2-1.give-me-dns.net.", dns.TypeA)
+	s.Equal("192-0-2-1.give-me-dns.net.\t172800\tIN\tA\t192.0.2.1", in.Answer[0].String())
+
+	// only allowed prefixes
+	in = query("198-51-100-1.give-me-dns.net.", dns.TypeA)
+	s.Empty(in.Answer)
+	s.Equal(dns.RcodeNameError, in.Rcode)
+
+	s.Contains(command("127.0.0.19", "ADD 2001-db8--1"), "The name 2001-db8--1 is not available\n")
+}
+
+func (s *GDNSTestSuite) TestReverse() {
+	res := command("127.0.0.20", "ADD")
+	name := reName.FindStringSubmatch(res)
+	s.NotNil(name, res)
+
+	in := query("20.0.0.127.in-addr.arpa.", dns.TypePTR)
+	s.Equal(dns.RcodeSuccess, in.Rcode)
+	s.Equal("20.0.0.127.in-addr.arpa.\t172800\tIN\tPTR\t"+name[1]+".", in.Answer[0].String())
+
+	m := new(dns.Msg)
+	m.SetQuestion("20.0.0.127.in-addr.arpa.", dns.TypePTR)
+	m.SetEdns0(4096, true)
+	in, err := dns.Exchange(m, "[::1]:5354")
+	s.NoError(err)
+	s.Equal(dns.TypeRRSIG, in.Answer[1].Header().Rrtype)
+	s.Equal("127.in-addr.arpa.", in.Answer[1].(*dns.RRSIG).SignerName)
+
+	in = query("127.in-addr.arpa.", dns.TypeDNSKEY)
+	s.Equal("127.in-addr.arpa.", in.Answer[0].Header().Name)
+
+	// addresses without names don't exist, the names leading to them do
+	in = query("21.0.0.127.in-addr.arpa.", dns.TypePTR)
+	s.Empty(in.Answer)
+	s.Equal(dns.RcodeNameError, in.Rcode)
+
+	in = query("0.0.127.in-addr.arpa.", dns.TypePTR)
+	s.Empty(in.Answer)
+	s.Equal(dns.RcodeSuccess, in.Rcode)
+}
+
+// signedQuery sends a query with the DO flag, and the CO flag if co is set
+func signedQuery(name string, qtype uint16, co bool) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(4096, true)
+	if co {
+		m.IsEdns0().Hdr.Ttl |= 1 << 14
+	}
+
+	in, err := dns.Exchange(m, "[::1]:5354")
+	if err != nil {
+		panic(err)
+	}
+
+	return in
+}
+
+func (s *GDNSTestSuite) TestDenial() {
+	in := signedQuery("give-me-dns.net.", dns.TypeDNSKEY, false)
+	dnskey := in.Answer[0].(*dns.DNSKEY)
+
+	// verify checks the signatures of the authority section and returns its NSEC
+	verify := func(in *dns.Msg) *dns.NSEC {
+		s.Len(in.Ns, 4)
+		soa, nsec := in.Ns[0].(*dns.SOA), in.Ns[2].(*dns.NSEC)
+		for i, rr := range []dns.RR{soa, nsec} {
+			rrsig := in.Ns[2*i+1].(*dns.RRSIG)
+			s.Equal(rr.Header().Rrtype, rrsig.TypeCovered)
+			s.NoError(rrsig.Verify(dnskey, []dns.RR{rr}))
+			s.True(rrsig.ValidityPeriod(time.Now()))
+		}
+
+		s.Equal("\\000."+nsec.Hdr.Name, nsec.NextDomain)
+		return nsec
+	}
+
+	// NODATA lists the types the name has
+	in = signedQuery("192-0-2-1.give-me-dns.net.", dns.TypeAAAA, false)
+	s.Equal(dns.RcodeSuccess, in.Rcode)
+	s.Empty(in.Answer)
+	nsec := verify(in)
+	s.Equal("192-0-2-1.give-me-dns.net.", nsec.Hdr.Name)
+	s.Equal([]uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC}, nsec.TypeBitMap)
+
+	in = signedQuery("give-me-dns.net.", dns.TypeA, false)
+	s.Equal(dns.RcodeSuccess, in.Rcode)
+	nsec = verify(in)
+	s.Equal([]uint16{dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY}, nsec.TypeBitMap)
+
+	// NXDOMAIN is marked by NXNAME, and only sent with the CO flag
+	in = signedQuery("nonexistent.give-me-dns.net.", dns.TypeA, false)
+	s.Equal(dns.RcodeSuccess, in.Rcode)
+	nsec = verify(in)
+	s.Equal([]uint16{dns.TypeRRSIG, dns.TypeNSEC, lib.TypeNXNAME}, nsec.TypeBitMap)
+
+	in = signedQuery("nonexistent.give-me-dns.net.", dns.TypeA, true)
+	s.Equal(dns.RcodeNameError, in.Rcode)
+	s.NotZero(in.IsEdns0().Hdr.Ttl & (1 << 14))
+	verify(in)
+}
+
+// jsonInfo gets /json from base with the X-Forwarded-For header forwarded
+func jsonInfo(base string, forwarded string) lib.JSONGet {
+	req, err := http.NewRequest("GET", base+"/json", nil)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("X-Forwarded-For", forwarded)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+
+	var reply struct {
+		Res lib.JSONGet `json:"res"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&reply)
+	if err != nil {
+		panic(err)
+	}
+
+	return reply.Res
+}
+
+func (s *GDNSTestSuite) TestTrustedProxies() {
+	time.Sleep(1 * time.Second)
+
+	// only the trusted proxy 127.0.0.1 may forward addresses, the last one it didn't add itself is the client
+	s.Equal("127.0.0.22", jsonInfo("http://127.0.0.1:8053", "127.0.0.22").Address.String())
+	s.Equal("127.0.0.22", jsonInfo("http://127.0.0.1:8053", "192.0.2.1, 127.0.0.22, 127.0.0.1").Address.String())
+	s.Equal("::1", jsonInfo("http://[::1]:8053", "127.0.0.22").Address.String())
 }
 
 func (s *GDNSTestSuite) TearDownSuite() {
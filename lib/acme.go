@@ -0,0 +1,322 @@
+package lib
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// FrontendACME is recorded in the history for changes by the acme-dns API
+const FrontendACME = "acme"
+
+// ACMEChallengeLabel is the label of the TXT records of the DNS-01 challenges below a name
+const ACMEChallengeLabel = "_acme-challenge"
+
+// acmeTXTRecords is how many TXT records are kept, so a name and its wildcard can be validated at once
+const acmeTXTRecords = 2
+
+// acmeTXTTTL is the TTL of the TXT records
+const acmeTXTTTL = 60
+
+var ErrInvalidTXT = errors.New("invalid TXT record, use the 43 characters of a DNS-01 challenge")
+var ErrInvalidAllowFrom = errors.New("invalid allowed address or prefix")
+
+var txtRe = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+// ACMEAccount is an acme-dns account of an entry, whose credentials update the TXT records of its DNS-01 challenges
+type ACMEAccount struct {
+	User string `json:"user"`
+	// KeyHash is the hex encoded SHA-256 of the key
+	KeyHash string `json:"key_hash"`
+	// AllowFrom are the prefixes the TXT records can be updated from, any if empty
+	AllowFrom []string `json:"allow_from,omitempty"`
+	// TXT are the TXT records, the most recent last
+	TXT []string `json:"txt,omitempty"`
+}
+
+// allowed reports whether the credentials and ip may update the account
+func (a *ACMEAccount) allowed(user string, key string, ip net.IP) bool {
+	if key == "" || subtle.ConstantTimeCompare([]byte(a.User), []byte(user)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(a.KeyHash), []byte(hashToken(key))) != 1 {
+		return false
+	}
+
+	if len(a.AllowFrom) == 0 {
+		return true
+	}
+	for _, allow := range a.AllowFrom {
+		prefix, err := parsePrefix(allow)
+		if err == nil && prefix.Contains(normalizeIP(ip)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RegisterACME creates a new acme-dns account for the entry id, or the entry of the client address if id is empty.
+// Replacing the previous one takes the token of the entry, the client address alone only registers the first.
+// It returns the entry holding the account and its key.
+func (s *Store) RegisterACME(id string, auth Auth, allowFrom []string) (Entry, string, string, error) {
+	var entry Entry
+
+	err := s.AssertDB()
+	if err != nil {
+		return entry, "", "", err
+	}
+
+	for _, allow := range allowFrom {
+		_, err := parsePrefix(allow)
+		if err != nil {
+			return entry, "", "", ErrInvalidAllowFrom
+		}
+	}
+
+	if s.primary != nil {
+		call := forwardCall("acme_register", id, auth)
+		call.AllowFrom = allowFrom
+		res, err := s.forward(call)
+		return res.entry(), res.Name, res.Secret, err
+	}
+
+	id = s.ParseID(id)
+
+	key, err := randomToken(25)
+	if err != nil {
+		return entry, "", "", err
+	}
+
+	err = s.change(auth, func(tx *storeTx) error {
+		var err error
+		id, entry, err = lookupManaged(tx, id, auth)
+		if err != nil {
+			return err
+		}
+		if entry.ACME != nil && auth.Token == "" && auth.Key == "" {
+			return ErrNotAllowed
+		}
+
+		entry.ACME = &ACMEAccount{
+			User:      uuid.NewString(),
+			KeyHash:   hashToken(key),
+			AllowFrom: allowFrom,
+		}
+		tx.emit(EventChanged, ReasonKeyIssued, id, &entry)
+
+		return tx.PutEntry(id, &entry)
+	})
+	if err != nil {
+		return entry, "", "", err
+	}
+
+	return entry, id + "." + s.Config.Domain, key, nil
+}
+
+// UpdateTXT adds txt to the TXT records of the DNS-01 challenges of the entry id, dropping the oldest one,
+// if user and key are the credentials of its acme-dns account and the client address is allowed.
+func (s *Store) UpdateTXT(id string, user string, key string, auth Auth, txt string) error {
+	err := s.AssertDB()
+	if err != nil {
+		return err
+	}
+
+	if !txtRe.MatchString(txt) {
+		return ErrInvalidTXT
+	}
+
+	if s.primary != nil {
+		call := forwardCall("acme_update", id, auth)
+		call.User = user
+		call.Token = key
+		call.TXT = txt
+		_, err := s.forward(call)
+		return err
+	}
+
+	id = s.ParseID(id)
+
+	return s.change(auth, func(tx *storeTx) error {
+		entry, err := getLiveEntry(tx, id)
+		if err != nil {
+			return err
+		}
+		if entry == nil || entry.ACME == nil || !entry.ACME.allowed(user, key, auth.IP) {
+			return ErrNotAllowed
+		}
+
+		account := *entry.ACME
+		account.TXT = append(append([]string{}, account.TXT...), txt)
+		if len(account.TXT) > acmeTXTRecords {
+			account.TXT = account.TXT[len(account.TXT)-acmeTXTRecords:]
+		}
+		entry.ACME = &account
+		tx.emit(EventChanged, ReasonChallenge, id, entry)
+
+		return tx.PutEntry(id, entry)
+	})
+}
+
+// resolveChallenge returns the entry of the DNS-01 challenges at name, which is _acme-challenge.<id>.<domain>.
+func resolveChallenge(name string, store *Store) *Entry {
+	id, ok := strings.CutPrefix(strings.ToLower(name), ACMEChallengeLabel+".")
+	if !ok {
+		return nil
+	}
+	id, ok = strings.CutSuffix(id, "."+store.Domain()+".")
+	if !ok || strings.Contains(id, ".") {
+		return nil
+	}
+
+	entry, err := store.ResolveEntry(id)
+	if err != nil || entry == nil {
+		return nil
+	}
+
+	return entry
+}
+
+// txtRRs returns the TXT records of the DNS-01 challenges of entry at name
+func txtRRs(name string, entry *Entry) []dns.RR {
+	if entry.ACME == nil {
+		return nil
+	}
+
+	var rrs []dns.RR
+	for _, txt := range entry.ACME.TXT {
+		rrs = append(rrs, &dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassINET,
+				Ttl:    acmeTXTTTL,
+			},
+			Txt: []string{txt},
+		})
+	}
+
+	return rrs
+}
+
+// ACMERegistration is the reply of /register, as sent by acme-dns
+type ACMERegistration struct {
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	FullDomain string   `json:"fulldomain"`
+	Subdomain  string   `json:"subdomain"`
+	AllowFrom  []string `json:"allowfrom"`
+}
+
+type acmeUpdate struct {
+	Subdomain string `json:"subdomain"`
+	TXT       string `json:"txt"`
+}
+
+// acmeError replies with an error as acme-dns does
+func acmeError(status int, msg string, writer http.ResponseWriter) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	_ = json.NewEncoder(writer).Encode(map[string]string{"error": msg})
+}
+
+// handleACME adds the endpoints of the acme-dns API to mux.
+// Accounts are registered for the name of the client address, or the one of the name and token given by basic auth,
+// which replacing an account takes.
+// The subdomain of an account is the name, so its fulldomain is the _acme-challenge record of the name itself.
+func handleACME(mux *http.ServeMux, store *Store) {
+	mux.HandleFunc("/register", func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != "POST" {
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		ip, err := getIP(writer, request)
+		if err != nil {
+			acmeError(http.StatusBadRequest, "bad_request", writer)
+			return
+		}
+
+		var req struct {
+			AllowFrom []string `json:"allowfrom"`
+		}
+		if request.ContentLength != 0 {
+			err := json.NewDecoder(io.LimitReader(request.Body, 4096)).Decode(&req)
+			if err != nil {
+				acmeError(http.StatusBadRequest, "malformed_json_payload", writer)
+				return
+			}
+		}
+
+		auth := Auth{IP: ip, Frontend: FrontendACME}
+		name, token, _ := request.BasicAuth()
+		auth.Token = token
+
+		entry, dnsName, key, err := store.RegisterACME(name, auth, req.AllowFrom)
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrInvalidAllowFrom):
+			acmeError(http.StatusBadRequest, "invalid_allowfrom_cidr", writer)
+			return
+		case errors.Is(err, ErrNoEntry), errors.Is(err, ErrNotFound), errors.Is(err, ErrNotAllowed):
+			acmeError(http.StatusUnauthorized, "forbidden", writer)
+			return
+		default:
+			jsonStoreError(err, FailedToUpdateEntry, writer)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(writer).Encode(&ACMERegistration{
+			Username:   entry.ACME.User,
+			Password:   key,
+			FullDomain: ACMEChallengeLabel + "." + dnsName,
+			Subdomain:  store.ParseID(dnsName),
+			AllowFrom:  append([]string{}, entry.ACME.AllowFrom...),
+		})
+	})
+
+	mux.HandleFunc("/update", func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != "POST" {
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		ip, err := getIP(writer, request)
+		if err != nil {
+			acmeError(http.StatusBadRequest, "bad_request", writer)
+			return
+		}
+
+		var req acmeUpdate
+		err = json.NewDecoder(io.LimitReader(request.Body, 4096)).Decode(&req)
+		if err != nil {
+			acmeError(http.StatusBadRequest, "malformed_json_payload", writer)
+			return
+		}
+
+		auth := Auth{IP: ip, Frontend: FrontendACME}
+		err = store.UpdateTXT(req.Subdomain, request.Header.Get("X-Api-User"), request.Header.Get("X-Api-Key"), auth, req.TXT)
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrInvalidTXT):
+			acmeError(http.StatusBadRequest, "bad_txt", writer)
+			return
+		case errors.Is(err, ErrNotAllowed):
+			acmeError(http.StatusUnauthorized, "forbidden", writer)
+			return
+		default:
+			jsonStoreError(err, FailedToUpdateEntry, writer)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(writer).Encode(map[string]string{"txt": req.TXT})
+	})
+}
@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"crypto/subtle"
+	"github.com/getsentry/sentry-go"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const FailedToGetHistory = "Failed to get history"
+const InvalidAddress = "Invalid address or prefix"
+const Unauthorized = "Unauthorized"
+
+// adminOnly lets only requests with the admin token through
+func adminOnly(config *HTTPConfig, handler http.HandlerFunc) http.HandlerFunc {
+	return bearerOnly(config.AdminToken, handler)
+}
+
+// hasBearer reports whether request has expected as bearer token, never if it is empty
+func hasBearer(expected string, request *http.Request) bool {
+	token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	return ok && expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// bearerOnly lets only requests with expected as bearer token through, if it is empty it lets none through
+func bearerOnly(expected string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if !hasBearer(expected, request) {
+			writer.Header().Set("WWW-Authenticate", "Bearer")
+			writer.WriteHeader(http.StatusUnauthorized)
+			jsonResponse(JSONReply{
+				Err: Unauthorized,
+			}, writer)
+			return
+		}
+
+		handler(writer, request)
+	}
+}
+
+// parsePrefix parses an address or a prefix in CIDR notation, addresses are treated as prefixes of their full length
+func parsePrefix(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, prefix, err := net.ParseCIDR(s)
+		return prefix, err
+	}
+
+	ip := normalizeIP(net.ParseIP(s))
+	if ip == nil {
+		return nil, net.InvalidAddrError(s)
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+}
+
+// handleAdmin adds the admin endpoints to mux
+func handleAdmin(mux *http.ServeMux, config *HTTPConfig, store *Store) {
+	// query the history by ?name= and/or ?ip= (an address or prefix)
+	mux.HandleFunc("/admin/history", adminOnly(config, func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != "GET" {
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var prefix *net.IPNet
+		if ip := request.URL.Query().Get("ip"); ip != "" {
+			var err error
+			prefix, err = parsePrefix(ip)
+			if err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				jsonResponse(JSONReply{
+					Err: InvalidAddress,
+				}, writer)
+				return
+			}
+		}
+
+		records, err := store.History(request.URL.Query().Get("name"), prefix)
+		if err != nil {
+			jsonStoreError(err, FailedToGetHistory, writer)
+			return
+		}
+
+		jsonResponse(JSONReply{
+			OK:  true,
+			Res: records,
+		}, writer)
+	}))
+
+	// stream a snapshot of the database, it can be used as store file of a new instance
+	mux.HandleFunc("/admin/backup", adminOnly(config, func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != "GET" {
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if _, ok := store.backend.(BackupBackend); !ok {
+			writer.WriteHeader(http.StatusNotImplemented)
+			jsonResponse(JSONReply{
+				Err: ErrBackupUnsupported.Error(),
+			}, writer)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/octet-stream")
+		writer.Header().Set("Content-Disposition", `attachment; filename="give-me-dns.db"`)
+		_, err := store.Backup(writer)
+		if err != nil { // the status was sent already, the client notices the broken download
+			sentry.CaptureException(err)
+			log.Printf("Backup failed: %s\n", err)
+		}
+	}))
+}
@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"github.com/mkg20001/give-me-dns/lib/idprov"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAdminBackup(t *testing.T) {
+	config := &StoreConfig{
+		Domain: "give-me-dns.net",
+		TTL:    time.Hour,
+	}
+	store := NewStore(config, NewBoltBackend(filepath.Join(t.TempDir(), "db")), []idprov.IDProv{idprov.ProvideRandomID(5)})
+	assert.NoError(t, store.Open())
+	defer store.Close()
+
+	ip := net.ParseIP("2001:db8::1")
+	_, name, err := store.AddEntry(Auth{IP: ip}, "")
+	assert.NoError(t, err)
+
+	mux := http.NewServeMux()
+	handleAdmin(mux, &HTTPConfig{AdminToken: "admin"}, store)
+
+	backup := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/admin/backup", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res := httptest.NewRecorder()
+		mux.ServeHTTP(res, req)
+		return res
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, backup("wrong").Code)
+
+	res := backup("admin")
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	// the backup is usable as file of a new instance
+	file := filepath.Join(t.TempDir(), "restored")
+	assert.NoError(t, os.WriteFile(file, res.Body.Bytes(), 0600))
+	restored := NewStore(config, NewBoltBackend(file), nil)
+	assert.NoError(t, restored.Open())
+	defer restored.Close()
+
+	_, restoredName, err := restored.ResolveIP(ip)
+	assert.NoError(t, err)
+	assert.Equal(t, name, restoredName)
+
+	// the memory backend has nothing to back up
+	mux = http.NewServeMux()
+	handleAdmin(mux, &HTTPConfig{AdminToken: "admin"}, testStore(t, &StoreConfig{TTL: time.Hour}))
+	assert.Equal(t, http.StatusNotImplemented, backup("admin").Code)
+}
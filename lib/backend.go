@@ -0,0 +1,82 @@
+package lib
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+var ErrNotOpen = errors.New("store is not open")
+var errTxReadOnly = errors.New("transaction is read-only")
+var ErrBackupUnsupported = errors.New("store backend does not support backups")
+
+// Backend persists the entries of a Store
+type Backend interface {
+	Open() error
+	Close() error
+	// View runs fn in a read-only transaction
+	View(fn func(tx BackendTx) error) error
+	// Update runs fn in a read-write transaction, none of its changes are kept if fn returns an error
+	Update(fn func(tx BackendTx) error) error
+}
+
+// BackendTx is a transaction of a Backend.
+// Addresses passed to it are normalized (see normalizeIP) and the entries returned by it are owned by the caller.
+type BackendTx interface {
+	// GetEntry returns the entry id, or nil if it doesn't exist
+	GetEntry(id string) (*Entry, error)
+	PutEntry(id string, entry *Entry) error
+	DeleteEntry(id string) error
+
+	// GetID returns the id of the entry ip is registered to, or "" if it isn't registered
+	GetID(ip net.IP) (string, error)
+	PutID(ip net.IP, id string) error
+	DeleteID(ip net.IP) error
+
+	// GetSerial returns the SOA serial of the zone, or 0 if it wasn't set yet
+	GetSerial() (uint32, error)
+	PutSerial(serial uint32) error
+
+	// AppendHistory adds record to the end of the history
+	AppendHistory(record *HistoryRecord) error
+	// DeleteHistory removes the records from before t
+	DeleteHistory(t time.Time) error
+
+	// ForEach calls fn for every entry, fn must not change the transaction (this holds for all ForEach functions)
+	ForEach(fn func(id string, entry *Entry) error) error
+	// ForEachIP calls fn for every registered address within prefix
+	ForEachIP(prefix *net.IPNet, fn func(ip net.IP, id string) error) error
+	// ForEachExpired calls fn for every entry that expired before now, without visiting the other entries if possible
+	ForEachExpired(now time.Time, fn func(id string, entry *Entry) error) error
+	// ForEachHistory calls fn for every record of the history, oldest first
+	ForEachHistory(fn func(record *HistoryRecord) error) error
+}
+
+// BackupBackend is implemented by backends that can write a consistent snapshot of their database while in use
+type BackupBackend interface {
+	// Backup writes the snapshot to w, in the format the backend reads its database from
+	Backup(w io.Writer) (int64, error)
+}
+
+// ProvideBackend returns the backend selected by the config
+func ProvideBackend(config *StoreConfig) (Backend, error) {
+	switch config.Backend {
+	case "", "bolt":
+		return NewBoltBackend(config.File), nil
+	case "memory":
+		return NewMemoryBackend(), nil
+	}
+
+	return nil, errors.New("unknown store backend " + config.Backend)
+}
+
+// ProvideReadOnlyBackend returns the backend selected by the config for reading its database without changing it
+func ProvideReadOnlyBackend(config *StoreConfig) (Backend, error) {
+	switch config.Backend {
+	case "", "bolt":
+		return NewReadOnlyBoltBackend(config.File), nil
+	}
+
+	return nil, errors.New("store backend " + config.Backend + " can't be read by other processes")
+}
@@ -0,0 +1,479 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// boltOpenTimeout is how long Open waits for other processes to release the file, like a running server when exporting
+const boltOpenTimeout = 5 * time.Second
+
+var ErrInUse = errors.New("store file is in use by another process")
+var ErrOutdatedDatabase = errors.New("database has to be upgraded by opening it for writing first")
+
+// BoltBackend stores the entries in a bbolt database file
+type BoltBackend struct {
+	db   *bolt.DB
+	file string
+	// readOnly opens the file for reading only, it has to be set up by a read-write instance already
+	readOnly bool
+	// openLock guards db, transactions hold it for reading so Close waits for them
+	openLock sync.RWMutex
+}
+
+func NewBoltBackend(file string) *BoltBackend {
+	return &BoltBackend{
+		file: file,
+	}
+}
+
+// NewReadOnlyBoltBackend returns a backend reading file without changing it, like while exporting
+func NewReadOnlyBoltBackend(file string) *BoltBackend {
+	return &BoltBackend{
+		file:     file,
+		readOnly: true,
+	}
+}
+
+func (b *BoltBackend) Open() error {
+	b.openLock.Lock()
+	defer b.openLock.Unlock()
+
+	if b.db != nil { // Idempotent
+		return nil
+	}
+
+	db, err := bolt.Open(b.file, 0600, &bolt.Options{Timeout: boltOpenTimeout, ReadOnly: b.readOnly})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return fmt.Errorf("%s: %w", b.file, ErrInUse)
+	}
+	if err != nil {
+		return err
+	}
+
+	if b.readOnly {
+		err = db.View(checkBoltSetup)
+		if err != nil {
+			_ = db.Close()
+			return err
+		}
+
+		b.db = db
+		return nil
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		// key: dns entry id - value: entry json
+		_, err := tx.CreateBucketIfNotExists([]byte("dns"))
+		if err != nil {
+			return err
+		}
+
+		// key: ip - value: dns entry id
+		_, err = tx.CreateBucketIfNotExists([]byte("dns4ip"))
+		if err != nil {
+			return err
+		}
+
+		// key: name - value: metadata like the serial
+		_, err = tx.CreateBucketIfNotExists([]byte("meta"))
+		if err != nil {
+			return err
+		}
+
+		// key: time (unix nanoseconds, big endian) + sequence - value: history record json
+		_, err = tx.CreateBucketIfNotExists([]byte("history"))
+		if err != nil {
+			return err
+		}
+
+		// key: expiry (unix nanoseconds, big endian) + dns entry id - value: empty
+		if tx.Bucket([]byte("expiry")) == nil {
+			_, err := tx.CreateBucket([]byte("expiry"))
+			if err != nil {
+				return err
+			}
+
+			// databases from before the index was added
+			t := &boltTx{tx: tx}
+			err = t.ForEach(func(id string, entry *Entry) error {
+				return t.expiry().Put(expiryKey(id, entry), nil)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		// the ipv4 key of the meta bucket marks databases whose IPv4 addresses were migrated, see migrateIPv4
+		meta := tx.Bucket([]byte("meta"))
+		if meta.Get([]byte("ipv4")) == nil {
+			err := migrateIPv4(&boltTx{tx: tx})
+			if err != nil {
+				return err
+			}
+
+			return meta.Put([]byte("ipv4"), []byte{1})
+		}
+
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return err
+	}
+
+	b.db = db
+
+	return nil
+}
+
+// checkBoltSetup returns ErrOutdatedDatabase if the buckets and migrations of Open are missing from tx
+func checkBoltSetup(tx *bolt.Tx) error {
+	for _, bucket := range []string{"dns", "dns4ip", "meta", "history", "expiry"} {
+		if tx.Bucket([]byte(bucket)) == nil {
+			return ErrOutdatedDatabase
+		}
+	}
+
+	if tx.Bucket([]byte("meta")).Get([]byte("ipv4")) == nil {
+		return ErrOutdatedDatabase
+	}
+
+	return nil
+}
+
+// migrateIPv4 moves the IPv4 addresses of databases from before entries had Value4, which stored them as Value
+// (served as IPv4-mapped AAAA records) with their 16-byte form as key, to Value4 and their 4-byte key
+func migrateIPv4(t *boltTx) error {
+	legacy := make(map[string]*Entry)
+	err := t.ForEach(func(id string, entry *Entry) error {
+		if entry.Value.To4() != nil {
+			legacy[id] = entry
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for id, entry := range legacy {
+		key := entry.Value.To16()
+		if entry.Value4 == nil {
+			entry.Value4 = key.To4()
+		}
+		entry.Value = nil
+
+		err := t.PutEntry(id, entry)
+		if err != nil {
+			return err
+		}
+
+		if string(t.dns4ip().Get(key)) != id {
+			continue
+		}
+		err = t.DeleteID(key)
+		if err != nil {
+			return err
+		}
+
+		owner, err := t.GetID(key.To4())
+		if err != nil {
+			return err
+		}
+		if owner == "" {
+			err := t.PutID(key.To4(), id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (b *BoltBackend) Close() error {
+	b.openLock.Lock()
+	defer b.openLock.Unlock()
+
+	if b.db == nil {
+		return nil
+	}
+
+	err := b.db.Close()
+	if err != nil {
+		return err
+	}
+
+	b.db = nil
+
+	return nil
+}
+
+func (b *BoltBackend) View(fn func(tx BackendTx) error) error {
+	b.openLock.RLock()
+	defer b.openLock.RUnlock()
+
+	if b.db == nil {
+		return ErrNotOpen
+	}
+
+	return b.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (b *BoltBackend) Update(fn func(tx BackendTx) error) error {
+	b.openLock.RLock()
+	defer b.openLock.RUnlock()
+
+	if b.db == nil {
+		return ErrNotOpen
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+// Backup writes a copy of the database file, it can be opened as file of another instance
+func (b *BoltBackend) Backup(w io.Writer) (int64, error) {
+	b.openLock.RLock()
+	defer b.openLock.RUnlock()
+
+	if b.db == nil {
+		return 0, ErrNotOpen
+	}
+
+	var n int64
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+
+	return n, err
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t *boltTx) dns() *bolt.Bucket {
+	return t.tx.Bucket([]byte("dns"))
+}
+
+func (t *boltTx) dns4ip() *bolt.Bucket {
+	return t.tx.Bucket([]byte("dns4ip"))
+}
+
+func (t *boltTx) expiry() *bolt.Bucket {
+	return t.tx.Bucket([]byte("expiry"))
+}
+
+func (t *boltTx) history() *bolt.Bucket {
+	return t.tx.Bucket([]byte("history"))
+}
+
+// expiryKey sorts the entries by their expiry
+func expiryKey(id string, entry *Entry) []byte {
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(entry.Expires.UnixNano()))
+	return append(key, id...)
+}
+
+func (t *boltTx) GetEntry(id string) (*Entry, error) {
+	raw := t.dns().Get([]byte(id))
+	if raw == nil {
+		return nil, nil
+	}
+
+	entry := &Entry{}
+	err := json.Unmarshal(raw, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+func (t *boltTx) PutEntry(id string, entry *Entry) error {
+	old, err := t.GetEntry(id)
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		err := t.expiry().Delete(expiryKey(id, old))
+		if err != nil {
+			return err
+		}
+	}
+
+	marshal, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	err = t.dns().Put([]byte(id), marshal)
+	if err != nil {
+		return err
+	}
+
+	return t.expiry().Put(expiryKey(id, entry), nil)
+}
+
+func (t *boltTx) DeleteEntry(id string) error {
+	old, err := t.GetEntry(id)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return nil
+	}
+
+	err = t.expiry().Delete(expiryKey(id, old))
+	if err != nil {
+		return err
+	}
+
+	return t.dns().Delete([]byte(id))
+}
+
+func (t *boltTx) GetID(ip net.IP) (string, error) {
+	return string(t.dns4ip().Get(ip)), nil
+}
+
+func (t *boltTx) PutID(ip net.IP, id string) error {
+	return t.dns4ip().Put(ip, []byte(id))
+}
+
+func (t *boltTx) DeleteID(ip net.IP) error {
+	return t.dns4ip().Delete(ip)
+}
+
+func (t *boltTx) GetSerial() (uint32, error) {
+	raw := t.tx.Bucket([]byte("meta")).Get([]byte("serial"))
+	if len(raw) != 4 {
+		return 0, nil
+	}
+
+	return binary.BigEndian.Uint32(raw), nil
+}
+
+func (t *boltTx) PutSerial(serial uint32) error {
+	raw := make([]byte, 4)
+	binary.BigEndian.PutUint32(raw, serial)
+
+	return t.tx.Bucket([]byte("meta")).Put([]byte("serial"), raw)
+}
+
+func (t *boltTx) AppendHistory(record *HistoryRecord) error {
+	seq, err := t.history().NextSequence()
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(record.Time.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+
+	marshal, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return t.history().Put(key, marshal)
+}
+
+func (t *boltTx) DeleteHistory(before time.Time) error {
+	end := make([]byte, 8)
+	binary.BigEndian.PutUint64(end, uint64(before.UnixNano()))
+
+	c := t.history().Cursor()
+	for key, _ := c.First(); key != nil && bytes.Compare(key[:8], end) < 0; key, _ = c.First() {
+		err := c.Delete()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *boltTx) ForEach(fn func(id string, entry *Entry) error) error {
+	return t.dns().ForEach(func(id []byte, raw []byte) error {
+		entry := &Entry{}
+		err := json.Unmarshal(raw, entry)
+		if err != nil {
+			return err
+		}
+
+		return fn(string(id), entry)
+	})
+}
+
+func (t *boltTx) ForEachIP(prefix *net.IPNet, fn func(ip net.IP, id string) error) error {
+	first := normalizeIP(prefix.IP)
+	last := make(net.IP, len(first))
+	for i := range first {
+		last[i] = first[i] | ^prefix.Mask[i]
+	}
+
+	// keys of the other family may sort in between, so they are skipped by their length
+	c := t.dns4ip().Cursor()
+	for ip, id := c.Seek(first); ip != nil && bytes.Compare(ip, last) <= 0; ip, id = c.Next() {
+		if len(ip) == len(first) && prefix.Contains(ip) {
+			err := fn(append(net.IP(nil), ip...), string(id))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (t *boltTx) ForEachExpired(now time.Time, fn func(id string, entry *Entry) error) error {
+	end := make([]byte, 8)
+	binary.BigEndian.PutUint64(end, uint64(now.UnixNano()))
+
+	// only the due part of the index is visited
+	c := t.expiry().Cursor()
+	for key, _ := c.First(); key != nil && bytes.Compare(key[:8], end) < 0; key, _ = c.Next() {
+		id := string(key[8:])
+		entry, err := t.GetEntry(id)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			continue
+		}
+
+		err = fn(id, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *boltTx) ForEachHistory(fn func(record *HistoryRecord) error) error {
+	return t.history().ForEach(func(key []byte, raw []byte) error {
+		record := &HistoryRecord{}
+		err := json.Unmarshal(raw, record)
+		if err != nil {
+			return err
+		}
+
+		return fn(record)
+	})
+}
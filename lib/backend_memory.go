@@ -0,0 +1,307 @@
+package lib
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryBackend keeps the entries in memory only, they are lost once the process exits
+type MemoryBackend struct {
+	entries map[string]*Entry
+	ids     map[string]string
+	history []*HistoryRecord
+	serial  uint32
+	open    bool
+	lock    sync.RWMutex
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		entries: make(map[string]*Entry),
+		ids:     make(map[string]string),
+	}
+}
+
+func (m *MemoryBackend) Open() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.open = true
+
+	return nil
+}
+
+func (m *MemoryBackend) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.open = false
+
+	return nil
+}
+
+func (m *MemoryBackend) View(fn func(tx BackendTx) error) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if !m.open {
+		return ErrNotOpen
+	}
+
+	return fn(&memoryTx{m: m})
+}
+
+func (m *MemoryBackend) Update(fn func(tx BackendTx) error) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.open {
+		return ErrNotOpen
+	}
+
+	tx := &memoryTx{m: m, writable: true}
+	err := fn(tx)
+	if err != nil {
+		tx.rollback()
+	}
+
+	return err
+}
+
+// cloneEntry copies an entry so callers can't modify the stored one
+func cloneEntry(entry *Entry) *Entry {
+	clone := *entry
+	clone.Value = append(net.IP(nil), entry.Value...)
+	clone.Value4 = append(net.IP(nil), entry.Value4...)
+	if entry.Value == nil {
+		clone.Value = nil
+	}
+	if entry.Value4 == nil {
+		clone.Value4 = nil
+	}
+	clone.Token = ""
+
+	return &clone
+}
+
+type memoryTx struct {
+	m        *MemoryBackend
+	writable bool
+	// undo restores the previous state, in reverse order
+	undo []func()
+}
+
+func (t *memoryTx) rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		t.undo[i]()
+	}
+	t.undo = nil
+}
+
+func (t *memoryTx) assertWritable() error {
+	if !t.writable {
+		return errTxReadOnly
+	}
+
+	return nil
+}
+
+func (t *memoryTx) GetEntry(id string) (*Entry, error) {
+	entry, ok := t.m.entries[id]
+	if !ok {
+		return nil, nil
+	}
+
+	return cloneEntry(entry), nil
+}
+
+func (t *memoryTx) PutEntry(id string, entry *Entry) error {
+	err := t.assertWritable()
+	if err != nil {
+		return err
+	}
+
+	old, existed := t.m.entries[id]
+	t.undo = append(t.undo, func() {
+		if existed {
+			t.m.entries[id] = old
+		} else {
+			delete(t.m.entries, id)
+		}
+	})
+	t.m.entries[id] = cloneEntry(entry)
+
+	return nil
+}
+
+func (t *memoryTx) DeleteEntry(id string) error {
+	err := t.assertWritable()
+	if err != nil {
+		return err
+	}
+
+	old, existed := t.m.entries[id]
+	if !existed {
+		return nil
+	}
+	t.undo = append(t.undo, func() {
+		t.m.entries[id] = old
+	})
+	delete(t.m.entries, id)
+
+	return nil
+}
+
+func (t *memoryTx) GetID(ip net.IP) (string, error) {
+	return t.m.ids[string(ip)], nil
+}
+
+func (t *memoryTx) PutID(ip net.IP, id string) error {
+	err := t.assertWritable()
+	if err != nil {
+		return err
+	}
+
+	key := string(ip)
+	old, existed := t.m.ids[key]
+	t.undo = append(t.undo, func() {
+		if existed {
+			t.m.ids[key] = old
+		} else {
+			delete(t.m.ids, key)
+		}
+	})
+	t.m.ids[key] = id
+
+	return nil
+}
+
+func (t *memoryTx) DeleteID(ip net.IP) error {
+	err := t.assertWritable()
+	if err != nil {
+		return err
+	}
+
+	key := string(ip)
+	old, existed := t.m.ids[key]
+	if !existed {
+		return nil
+	}
+	t.undo = append(t.undo, func() {
+		t.m.ids[key] = old
+	})
+	delete(t.m.ids, key)
+
+	return nil
+}
+
+func (t *memoryTx) GetSerial() (uint32, error) {
+	return t.m.serial, nil
+}
+
+func (t *memoryTx) PutSerial(serial uint32) error {
+	err := t.assertWritable()
+	if err != nil {
+		return err
+	}
+
+	old := t.m.serial
+	t.undo = append(t.undo, func() {
+		t.m.serial = old
+	})
+	t.m.serial = serial
+
+	return nil
+}
+
+func (t *memoryTx) AppendHistory(record *HistoryRecord) error {
+	err := t.assertWritable()
+	if err != nil {
+		return err
+	}
+
+	old := t.m.history
+	t.undo = append(t.undo, func() {
+		t.m.history = old
+	})
+	clone := *record
+	t.m.history = append(t.m.history[:len(old):len(old)], &clone)
+
+	return nil
+}
+
+func (t *memoryTx) DeleteHistory(before time.Time) error {
+	err := t.assertWritable()
+	if err != nil {
+		return err
+	}
+
+	old := t.m.history
+	t.undo = append(t.undo, func() {
+		t.m.history = old
+	})
+
+	i := sort.Search(len(old), func(i int) bool {
+		return !old[i].Time.Before(before)
+	})
+	t.m.history = old[i:]
+
+	return nil
+}
+
+func (t *memoryTx) ForEach(fn func(id string, entry *Entry) error) error {
+	ids := make([]string, 0, len(t.m.entries))
+	for id := range t.m.entries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		err := fn(id, cloneEntry(t.m.entries[id]))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *memoryTx) ForEachIP(prefix *net.IPNet, fn func(ip net.IP, id string) error) error {
+	first := normalizeIP(prefix.IP)
+
+	for key, id := range t.m.ids {
+		ip := net.IP(key)
+		if len(ip) == len(first) && prefix.Contains(ip) {
+			err := fn(append(net.IP(nil), ip...), id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (t *memoryTx) ForEachExpired(now time.Time, fn func(id string, entry *Entry) error) error {
+	return t.ForEach(func(id string, entry *Entry) error {
+		if entry.Expires.Before(now) {
+			return fn(id, entry)
+		}
+
+		return nil
+	})
+}
+
+func (t *memoryTx) ForEachHistory(fn func(record *HistoryRecord) error) error {
+	for _, record := range t.m.history {
+		clone := *record
+		err := fn(&clone)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,246 @@
+package lib
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testBackend(t *testing.T, backend Backend) {
+	assert.NoError(t, backend.Open())
+	defer backend.Close()
+
+	ip4 := net.ParseIP("192.0.2.1").To4()
+	ip6 := net.ParseIP("2001:db8::1")
+	now := time.Now()
+
+	err := backend.Update(func(tx BackendTx) error {
+		for id, expires := range map[string]time.Time{"live": now.Add(time.Hour), "gone": now.Add(-time.Hour)} {
+			err := tx.PutEntry(id, &Entry{Expires: expires, Value: ip6, Value4: ip4})
+			if err != nil {
+				return err
+			}
+		}
+
+		serial, err := tx.GetSerial()
+		assert.Equal(t, uint32(0), serial)
+		if err != nil {
+			return err
+		}
+
+		err = tx.PutSerial(42)
+		if err != nil {
+			return err
+		}
+
+		err = tx.PutID(ip4, "live")
+		if err != nil {
+			return err
+		}
+
+		return tx.PutID(ip6, "live")
+	})
+	assert.NoError(t, err)
+
+	// changes of failed transactions are rolled back
+	err = backend.Update(func(tx BackendTx) error {
+		err := tx.DeleteEntry("live")
+		if err != nil {
+			return err
+		}
+
+		err = tx.DeleteID(ip4)
+		if err != nil {
+			return err
+		}
+
+		err = tx.PutSerial(43)
+		if err != nil {
+			return err
+		}
+
+		return errors.New("fail")
+	})
+	assert.EqualError(t, err, "fail")
+
+	// moving the expiry of an entry moves it in the index
+	err = backend.Update(func(tx BackendTx) error {
+		entry, err := tx.GetEntry("gone")
+		if err != nil {
+			return err
+		}
+
+		entry.Expires = now.Add(2 * time.Hour)
+		err = tx.PutEntry("gone", entry)
+		if err != nil {
+			return err
+		}
+
+		entry.Expires = now.Add(-2 * time.Hour)
+		return tx.PutEntry("gone", entry)
+	})
+	assert.NoError(t, err)
+
+	err = backend.View(func(tx BackendTx) error {
+		entry, err := tx.GetEntry("live")
+		assert.NoError(t, err)
+		assert.NotNil(t, entry)
+		assert.True(t, entry.HasIP(ip4))
+		assert.True(t, entry.HasIP(ip6))
+
+		entry, err = tx.GetEntry("missing")
+		assert.NoError(t, err)
+		assert.Nil(t, entry)
+
+		id, err := tx.GetID(ip4)
+		assert.NoError(t, err)
+		assert.Equal(t, "live", id)
+
+		serial, err := tx.GetSerial()
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(42), serial)
+
+		var ids []string
+		err = tx.ForEach(func(id string, entry *Entry) error {
+			ids = append(ids, id)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"gone", "live"}, ids)
+
+		var expired []string
+		err = tx.ForEachExpired(now, func(id string, entry *Entry) error {
+			expired = append(expired, id)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"gone"}, expired)
+
+		var ips []string
+		_, prefix, _ := net.ParseCIDR("192.0.2.0/24")
+		err = tx.ForEachIP(prefix, func(ip net.IP, id string) error {
+			ips = append(ips, ip.String())
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"192.0.2.1"}, ips)
+
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// the history is kept in order and the oldest records can be removed
+	err = backend.Update(func(tx BackendTx) error {
+		for i, action := range []EventReason{ReasonRegistered, ReasonRenewed, ReasonReleased} {
+			err := tx.AppendHistory(&HistoryRecord{Time: now.Add(time.Duration(i) * time.Hour), Action: action, Name: "live"})
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.DeleteHistory(now.Add(time.Minute))
+	})
+	assert.NoError(t, err)
+
+	err = backend.View(func(tx BackendTx) error {
+		var actions []EventReason
+		err := tx.ForEachHistory(func(record *HistoryRecord) error {
+			actions = append(actions, record.Action)
+			return nil
+		})
+		assert.Equal(t, []EventReason{ReasonRenewed, ReasonReleased}, actions)
+
+		return err
+	})
+	assert.NoError(t, err)
+}
+
+func TestBoltBackend(t *testing.T) {
+	testBackend(t, NewBoltBackend(filepath.Join(t.TempDir(), "db")))
+}
+
+func TestMemoryBackend(t *testing.T) {
+	testBackend(t, NewMemoryBackend())
+}
+
+func TestBoltBackendMigrateIPv4(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db")
+
+	// databases from before entries had Value4 stored IPv4 addresses as Value, with their 16-byte form as key
+	db, err := bolt.Open(file, 0600, nil)
+	assert.NoError(t, err)
+	err = db.Update(func(tx *bolt.Tx) error {
+		bDNS, err := tx.CreateBucket([]byte("dns"))
+		if err != nil {
+			return err
+		}
+		bIP, err := tx.CreateBucket([]byte("dns4ip"))
+		if err != nil {
+			return err
+		}
+
+		expires := time.Now().Add(time.Hour).Format(time.RFC3339)
+		err = bDNS.Put([]byte("abcde"), []byte(`{"expires":"`+expires+`","value":"192.0.2.1"}`))
+		if err != nil {
+			return err
+		}
+
+		return bIP.Put(net.ParseIP("192.0.2.1").To16(), []byte("abcde"))
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	store := NewStore(&StoreConfig{Domain: "give-me-dns.net"}, NewBoltBackend(file), nil)
+	assert.NoError(t, store.Open())
+	defer store.Close()
+
+	entry, id, err := store.ResolveIP(net.ParseIP("192.0.2.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "abcde.give-me-dns.net", id)
+	assert.Nil(t, entry.Value)
+	assert.True(t, entry.Value4.Equal(net.ParseIP("192.0.2.1")))
+
+	err = store.backend.View(func(tx BackendTx) error {
+		id, err := tx.GetID(net.ParseIP("192.0.2.1").To16())
+		assert.Empty(t, id)
+		return err
+	})
+	assert.NoError(t, err)
+}
+
+func TestBoltBackendReadOnly(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db")
+
+	// only databases set up by a read-write instance can be read
+	store := NewStore(&StoreConfig{Domain: "give-me-dns.net"}, NewReadOnlyBoltBackend(file), nil)
+	assert.Error(t, store.OpenReadOnly())
+
+	store = NewStore(&StoreConfig{Domain: "give-me-dns.net", TTL: time.Hour}, NewBoltBackend(file), nil)
+	assert.NoError(t, store.Open())
+	_, name, err := store.AddEntry(Auth{IP: net.ParseIP("2001:db8::1")}, "readonly")
+	assert.NoError(t, err)
+	serial := store.GetSerial()
+
+	// the file is locked while the store is open
+	err, _, _ = ProvideReadOnlyStore(&StoreConfig{Domain: "give-me-dns.net", File: file})
+	assert.ErrorIs(t, err, ErrInUse)
+	assert.NoError(t, store.Close())
+
+	err, closeStore, store := ProvideReadOnlyStore(&StoreConfig{Domain: "give-me-dns.net", File: file})
+	assert.NoError(t, err)
+	assert.Equal(t, serial, store.GetSerial())
+	_, err = store.ResolveEntry(store.ParseID(name))
+	assert.NoError(t, err)
+	_, _, err = store.AddEntry(Auth{IP: net.ParseIP("2001:db8::2")}, "")
+	assert.Error(t, err)
+	assert.NoError(t, closeStore())
+
+	store = NewStore(&StoreConfig{Domain: "give-me-dns.net"}, NewReadOnlyBoltBackend(file), nil)
+	assert.NoError(t, store.OpenReadOnly())
+	assert.Equal(t, serial, store.GetSerial())
+	assert.NoError(t, store.Close())
+}
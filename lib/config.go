@@ -14,6 +14,9 @@ type Config struct {
 	Net   NetConfig   `yaml:"net"`
 	HTTP  HTTPConfig  `yaml:"http"`
 
+	RateLimit RateLimitConfig `yaml:"ratelimit"`
+	Webhooks  []WebhookConfig `yaml:"webhooks,omitempty"`
+
 	Provider ProviderConfig `yaml:"provider"`
 }
 
@@ -38,22 +41,137 @@ type DNSConfig struct {
 	MNAME     string   `yaml:"mname"`
 	NS        []string `yaml:"ns"`
 	DNSSECKey string   `yaml:"dnssec_key,omitempty"`
+	// DNSSECZSK is a separate key signing the zone, leaving dnssec_key to sign its DNSKEY set only
+	DNSSECZSK string `yaml:"dnssec_zsk,omitempty"`
+
+	SOA      SOAConfig      `yaml:"soa,omitempty"`
+	Transfer TransferConfig `yaml:"transfer,omitempty"`
+	Embedded EmbeddedConfig `yaml:"embedded,omitempty"`
+	// Reverse are the reverse zones delegated to this server, answering PTR queries for the registered addresses
+	Reverse []ReverseZoneConfig `yaml:"reverse,omitempty"`
+}
+
+type ReverseZoneConfig struct {
+	// Zone is the name of the zone, like 8.b.d.0.1.0.0.2.ip6.arpa or 2.0.192.in-addr.arpa
+	Zone string `yaml:"zone"`
+	// DNSSECKey is the key the zone is signed with, like the dnssec_key of the domain
+	DNSSECKey string `yaml:"dnssec_key,omitempty"`
+	// DNSSECZSK is the separate key signing the zone, like the dnssec_zsk of the domain
+	DNSSECZSK string `yaml:"dnssec_zsk,omitempty"`
+}
+
+// EmbeddedConfig lets names embedding an address (192-0-2-1 or 2001-db8--1) resolve to it without registering them
+type EmbeddedConfig struct {
+	Enable bool `yaml:"enable"`
+	// Allow are the addresses or prefixes that can be embedded, any if empty
+	Allow []string `yaml:"allow,omitempty"`
+}
+
+// SOAConfig are the timers of the SOA record
+type SOAConfig struct {
+	// Refresh is how often secondaries check for changes, defaults to 1h
+	Refresh time.Duration `yaml:"refresh,omitempty"`
+	// Retry is how soon secondaries check again after a failed refresh, defaults to 10m
+	Retry time.Duration `yaml:"retry,omitempty"`
+	// Expire is how long secondaries keep serving the zone without a successful refresh, defaults to 1 week
+	Expire time.Duration `yaml:"expire,omitempty"`
+	// Minimum is the TTL of negative answers, defaults to 1h
+	Minimum time.Duration `yaml:"minimum,omitempty"`
+}
+
+// TransferConfig lets secondaries transfer the zone with AXFR and IXFR.
+// The transferred zone is unsigned, as its signatures are only created when answering queries.
+type TransferConfig struct {
+	// Allow are the addresses or prefixes allowed to transfer the zone, transfers are disabled without any
+	Allow []string `yaml:"allow,omitempty"`
+	// TSIGKeys maps key names to base64 encoded HMAC-SHA256 secrets, if set transfers must be signed with one of them
+	TSIGKeys map[string]string `yaml:"tsig_keys,omitempty"`
+
+	// Notify are the secondaries (host:port, port 53 if omitted) that get a NOTIFY when the zone changes
+	Notify []string `yaml:"notify,omitempty"`
+	// NotifyDelay is how long changes are collected before notifying the secondaries, defaults to 5s
+	NotifyDelay time.Duration `yaml:"notify_delay,omitempty"`
+	// NotifyKey is the name of the key of TSIGKeys the NOTIFY messages are signed with, they are unsigned without one
+	NotifyKey string `yaml:"notify_key,omitempty"`
 }
 
 type NetConfig struct {
-	Address string `yaml:"address"`
-	Port    int16  `yaml:"port"`
+	Address     string        `yaml:"address"`
+	Port        int16         `yaml:"port"`
+	ReadTimeout time.Duration `yaml:"read_timeout,omitempty"`
 }
 
 type HTTPConfig struct {
 	Address string `yaml:"address"`
 	Port    int16  `yaml:"port"`
+	// AdminToken is the bearer token of the admin endpoints under /admin/, they are disabled without one
+	AdminToken string `yaml:"admin_token,omitempty"`
+	// TrustedProxies are the addresses or prefixes of the reverse proxies whose X-Forwarded-For is used as client address,
+	// it is ignored from everyone else
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty"`
+}
+
+type RateLimitConfig struct {
+	Rules []RateLimitRule `yaml:"rules"`
+}
+
+// RateLimitRule limits the clients of each prefix, clients within the same prefix share the limits
+type RateLimitRule struct {
+	// Prefix4 is the prefix length IPv4 clients are grouped by, up to 32 which is the default
+	Prefix4 int `yaml:"prefix4,omitempty"`
+	// Prefix6 is the prefix length IPv6 clients are grouped by, up to 128, defaults to 64
+	Prefix6 int `yaml:"prefix6,omitempty"`
+	// Requests is the number of requests allowed per Interval, 0 means no limit
+	Requests int           `yaml:"requests,omitempty"`
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// MaxEntries is the number of addresses that can be registered at once, 0 means no limit
+	MaxEntries int `yaml:"max_entries,omitempty"`
+}
+
+// WebhookConfig is a target receiving the lifecycle events of the entries as JSON POSTs, replicas don't send any
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+	// Secret signs the requests, the hex encoded HMAC-SHA256 of the body is sent as "X-Signature: sha256=<hmac>"
+	Secret string `yaml:"secret,omitempty"`
+	// Events are the events sent to the target, defaults to all of registered, renewed, updated, released, expiring, expired,
+	// renamed and address_taken
+	Events []string `yaml:"events,omitempty"`
+	// ExpiringIn is how long before the expiry of an entry the expiring event is sent, defaults to 1h
+	ExpiringIn time.Duration `yaml:"expiring_in,omitempty"`
+	// Retries is how often failed requests are retried, with the delay doubling from RetryDelay each time, defaults to 5.
+	// -1 disables retrying.
+	Retries    int           `yaml:"retries,omitempty"`
+	RetryDelay time.Duration `yaml:"retry_delay,omitempty"`
+	// Timeout of each request, defaults to 10s
+	Timeout time.Duration `yaml:"timeout,omitempty"`
 }
 
 type StoreConfig struct {
-	Domain string        `yaml:"domain"`
-	File   string        `yaml:"file"`
-	TTL    time.Duration `yaml:"ttl"`
+	Domain string `yaml:"domain"`
+	// Backend is either "bolt" (default), storing the entries in File, or "memory"
+	Backend string        `yaml:"backend,omitempty"`
+	File    string        `yaml:"file"`
+	TTL     time.Duration `yaml:"ttl"`
+	LinkTTL time.Duration `yaml:"link_ttl,omitempty"`
+	// MaxLifetime limits how long a name can be kept alive by renewing it, 0 means no limit
+	MaxLifetime time.Duration `yaml:"max_lifetime,omitempty"`
+	// SweepInterval is how often expired entries are removed, defaults to 1m
+	SweepInterval time.Duration `yaml:"sweep_interval,omitempty"`
+	// HistoryRetention is how long the history of the changes is kept, defaults to 30 days, negative disables the history
+	HistoryRetention time.Duration `yaml:"history_retention,omitempty"`
+	// Reserved names can't be requested by clients
+	Reserved []string `yaml:"reserved,omitempty"`
+
+	Replication ReplicationConfig `yaml:"replication,omitempty"`
+}
+
+// ReplicationConfig lets replicas follow the store of a primary
+type ReplicationConfig struct {
+	// Primary is the URL of the HTTP frontend of the primary, setting it makes this instance a replica.
+	// Replicas serve the entries of the primary and forward all changes to it.
+	Primary string `yaml:"primary,omitempty"`
+	// Token authenticates the replicas at the primary, replication is disabled on a primary without one
+	Token string `yaml:"token,omitempty"`
 }
 
 func ReadConfig(path string) (*Config, error) {
@@ -6,150 +6,317 @@ import (
 	"crypto/ecdsa"
 	"crypto/rsa"
 	"encoding/base64"
+	"errors"
 	"github.com/getsentry/sentry-go"
 	"github.com/miekg/dns"
 	"log"
 	"net"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
-func resolveDomain(q dns.Question, store *Store) net.IP {
-	labelIndexes := dns.Split(q.Name)
-	if len(labelIndexes) < 2 {
+var ErrNoNS = errors.New("dns.ns has to list at least one name server, the first one is the primary of the SOA")
+
+const DefaultSOARefresh = 1 * time.Hour
+const DefaultSOARetry = 10 * time.Minute
+const DefaultSOAExpire = 7 * 24 * time.Hour
+const DefaultSOAMinimum = 1 * time.Hour
+
+// signatureSkew is how long signatures are valid before they are made and after the records expire, for clocks being off
+const signatureSkew = 1 * time.Hour
+
+// seconds returns d, or def if d is unset, in seconds
+func seconds(d time.Duration, def time.Duration) uint32 {
+	if d == 0 {
+		d = def
+	}
+
+	return uint32(d.Seconds())
+}
+
+// resolveDomain returns the entry named by q, which is exactly one label below the domain
+func resolveDomain(q dns.Question, store *Store, config *DNSConfig) *Entry {
+	lastBlock, ok := strings.CutSuffix(strings.ToLower(q.Name), "."+store.Domain()+".")
+	if !ok || lastBlock == "" || strings.Contains(lastBlock, ".") {
 		return nil
 	}
-	lastBlock := strings.ToLower(q.Name)[labelIndexes[0] : labelIndexes[1]-1]
-	ip, err := store.ResolveEntry(lastBlock)
+	entry, err := store.ResolveEntry(lastBlock)
 	if err != nil {
 		sentry.CaptureException(err)
 		log.Printf("Failed to resolve: %s", err)
 		return nil
 	}
-	if ip != nil {
-		return ip
+
+	if entry == nil {
+		return resolveEmbedded(lastBlock, &config.Embedded)
 	}
 
-	return nil
+	return entry
 }
 
-func parseDNSQuery(r *dns.Msg, m *dns.Msg, store *Store, config *DNSConfig, s *DNSSECSigner) {
-	m.Authoritative = true
-	shouldSign := false
+// addressRR returns the A or AAAA record of ip for name
+func addressRR(name string, ip net.IP, store *Store) dns.RR {
+	hdr := dns.RR_Header{
+		Name:   name,
+		Rrtype: dns.TypeAAAA,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(store.Config.TTL.Seconds()),
+	}
 
-	main := store.Config.Domain + "."
+	if ip4 := ip.To4(); ip4 != nil {
+		hdr.Rrtype = dns.TypeA
+		return &dns.A{Hdr: hdr, A: ip4}
+	}
+
+	return &dns.AAAA{Hdr: hdr, AAAA: ip}
+}
 
-	if r.IsEdns0() != nil {
-		if r.IsEdns0().Do() {
-			shouldSign = true
+// nsRRs returns the NS records of zone
+func nsRRs(config *DNSConfig, zone string) []dns.RR {
+	var rrs []dns.RR
+	for _, ns := range config.NS {
+		nsrr := new(dns.NS)
+		nsrr.Ns = ns
+		nsrr.Hdr = dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeNS,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
 		}
-		m.SetEdns0(4096, shouldSign)
+		rrs = append(rrs, nsrr)
 	}
 
+	return rrs
+}
+
+// ZoneRRs returns all records of the zone, starting with its SOA and NS records
+func ZoneRRs(config *DNSConfig, store *Store) ([]dns.RR, error) {
+	s := &DNSSECSigner{
+		config: config,
+		store:  store,
+	}
+	var entries []dns.RR
+
+	// the serial and the entries are read together, so the SOA matches the records
+	serial, err := store.ForEachSerial(func(name string, entry Entry) error {
+		for _, ip := range entry.IPs() {
+			entries = append(entries, addressRR(name+".", ip, store))
+		}
+		entries = append(entries, txtRRs(ACMEChallengeLabel+"."+name+".", &entry)...)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rrs := append([]dns.RR{s.soa(serial)}, nsRRs(config, store.Domain()+".")...)
+	return append(rrs, entries...), nil
+}
+
+func parseDNSQuery(r *dns.Msg, m *dns.Msg, store *Store, config *DNSConfig, s *DNSSECSigner) {
+	m.Authoritative = true
+
+	main := store.Config.Domain + "."
+	shouldSign := replyEdns0(r, m)
+
 	for _, q := range m.Question {
 		ismain := strings.ToLower(q.Name) == main
 
+		var answer []dns.RR
+
 		log.Printf("Question %s", q.String())
 
 		switch q.Qtype {
 		case dns.TypeDNSKEY:
 			if ismain {
 				log.Printf("A DNSKEY")
-				m.Answer = append(m.Answer, s.GetDNSKEY())
+				answer = append(answer, s.GetDNSKEYs()...)
 			}
 		case dns.TypeNS:
 			if ismain {
 				log.Printf("A NS")
-				for _, ns := range config.NS {
-					nsrr := new(dns.NS)
-					nsrr.Ns = ns
-					nsrr.Hdr = dns.RR_Header{
-						Name:   q.Name,
-						Rrtype: dns.TypeNS,
-						Class:  dns.ClassINET,
-						Ttl:    3600,
-					}
-					m.Answer = append(m.Answer, nsrr)
-				}
+				answer = append(answer, nsRRs(config, store.Domain()+".")...)
 			}
 		case dns.TypeSOA:
 			if ismain && q.Qtype == dns.TypeSOA {
 				log.Printf("A SOA")
-				m.Answer = append(m.Answer, s.GetSOA())
+				answer = append(answer, s.GetSOA())
 			}
 		case dns.TypeAAAA:
 			log.Printf("Query for %s\n", q.Name)
-			ip := resolveDomain(q, store)
-			if ip != nil {
-				r := new(dns.AAAA)
-				r.Hdr = dns.RR_Header{
-					Name:   q.Name,
-					Rrtype: dns.TypeAAAA,
-					Class:  dns.ClassINET,
-					Ttl:    uint32(store.Config.TTL.Seconds()),
-				}
-				r.AAAA = ip
-
-				log.Printf("Query for %s - Resolved %s\n", q.Name, ip)
-				m.Answer = append(m.Answer, r)
+			entry := resolveDomain(q, store, config)
+			if entry != nil && entry.Value != nil {
+				log.Printf("Query for %s - Resolved %s\n", q.Name, entry.Value)
+				answer = append(answer, addressRR(q.Name, entry.Value, store))
+			}
+		case dns.TypeTXT:
+			if entry := resolveChallenge(q.Name, store); entry != nil {
+				answer = append(answer, txtRRs(q.Name, entry)...)
+			}
+		case dns.TypeA:
+			log.Printf("Query for %s\n", q.Name)
+			entry := resolveDomain(q, store, config)
+			if entry != nil && entry.Value4 != nil {
+				log.Printf("Query for %s - Resolved %s\n", q.Name, entry.Value4)
+				answer = append(answer, addressRR(q.Name, entry.Value4, store))
 			}
 		}
 
-		if len(m.Answer) > 0 {
-			if shouldSign {
-				rrsig, err := s.Sign(m.Answer)
-				if err != nil {
-					sentry.CaptureException(err)
-					log.Printf("dnssec err: %s", err)
-					return
-				}
-				m.Answer = append(m.Answer, rrsig)
+		err := finishAnswer(m, q, answer, s, shouldSign, func() ([]uint16, bool) {
+			if ismain {
+				return []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeDNSKEY}, true
 			}
-		} else {
-			soa := s.GetSOA()
-			m.Ns = append(m.Ns, soa)
-
-			if shouldSign {
-				nsec := &dns.NSEC{
-					Hdr: dns.RR_Header{
-						Name:   q.Name,
-						Rrtype: dns.TypeNSEC,
-						Class:  dns.ClassINET,
-						Ttl:    3600,
-					},
-					NextDomain: "\000" + "." + q.Name,
-					TypeBitMap: []uint16{dns.TypeNS, dns.TypeSOA},
+			if entry := resolveChallenge(q.Name, store); entry != nil {
+				if entry.ACME != nil && len(entry.ACME.TXT) > 0 {
+					return []uint16{dns.TypeTXT}, true
 				}
-				m.Ns = append(m.Ns, nsec)
+				return nil, true
+			}
+			if entry := resolveDomain(q, store, config); entry != nil {
+				return entryTypes(entry), true
+			}
+			return nil, false
+		})
+		if err != nil {
+			servFail(m, err)
+			return
+		}
+	}
+}
 
-				rrsig, err := s.Sign([]dns.RR{soa})
-				if err != nil {
-					sentry.CaptureException(err)
-					log.Printf("dnssec err: %s", err)
-					return
-				}
-				m.Ns = append(m.Ns, rrsig)
+// TypeNXNAME is the pseudo type marking names that don't exist in compact denial of existence (RFC 9824)
+const TypeNXNAME = 128
 
-				rrsig2, err := s.Sign([]dns.RR{nsec})
-				if err != nil {
-					sentry.CaptureException(err)
-					log.Printf("dnssec err: %s", err)
-					return
-				}
-				m.Ns = append(m.Ns, rrsig2)
-			} else {
-				ip := resolveDomain(q, store)
-				if !ismain && ip == nil {
-					m.Rcode = dns.RcodeNameError
-				}
+// ednsCO is the Compact Answers OK flag, with which clients accept NXDOMAIN for compact denial of existence (RFC 9824)
+const ednsCO = 1 << 14
+
+// replyEdns0 adds the EDNS0 record of the reply to r to m and returns whether it should be signed
+func replyEdns0(r *dns.Msg, m *dns.Msg) bool {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	m.SetEdns0(4096, opt.Do())
+	if opt.Do() && opt.Hdr.Ttl&ednsCO != 0 {
+		m.IsEdns0().Hdr.Ttl |= ednsCO
+	}
+
+	return opt.Do()
+}
+
+// finishAnswer adds the answer to q to m, or the SOA (and NSEC) if it is empty, signing each RRset if shouldSign is set.
+// lookup returns the types at the name of q and whether it exists, it is NXDOMAIN otherwise.
+//
+// Empty answers are denied with compact denial of existence (RFC 9824): the NSEC of the name only covers
+// the name itself and lists its types, marking names that don't exist with NXNAME. As the NSEC proves
+// the name is missing, NXDOMAIN is only signed for clients setting the CO flag.
+func finishAnswer(m *dns.Msg, q dns.Question, answer []dns.RR, s *DNSSECSigner, shouldSign bool, lookup func() ([]uint16, bool)) error {
+	if len(answer) > 0 {
+		if shouldSign {
+			var err error
+			answer, err = s.SignRRsets(answer)
+			if err != nil {
+				return err
 			}
 		}
+		m.Answer = append(m.Answer, answer...)
+
+		return nil
+	}
+
+	soa := s.GetSOA()
+	authority := []dns.RR{soa}
+
+	types, exists := lookup()
+	if !exists && (!shouldSign || m.IsEdns0().Hdr.Ttl&ednsCO != 0) {
+		m.Rcode = dns.RcodeNameError
+	}
+
+	if shouldSign {
+		var err error
+		authority, err = s.SignRRsets(append(authority, denialNSEC(q.Name, soa, types, exists)))
+		if err != nil {
+			return err
+		}
+	}
+	m.Ns = append(m.Ns, authority...)
+
+	return nil
+}
+
+// servFail replaces the answer in m with SERVFAIL, after err occurred answering
+func servFail(m *dns.Msg, err error) {
+	sentry.CaptureException(err)
+	log.Printf("dnssec err: %s", err)
+
+	m.Answer = nil
+	m.Ns = nil
+	m.Rcode = dns.RcodeServerFailure
+}
+
+// denialNSEC returns the NSEC denying everything but types at name, whose next name is its immediate successor
+func denialNSEC(name string, soa *dns.SOA, types []uint16, exists bool) *dns.NSEC {
+	bitmap := append([]uint16{dns.TypeRRSIG, dns.TypeNSEC}, types...)
+	if !exists {
+		bitmap = append(bitmap, TypeNXNAME)
+	}
+	sort.Slice(bitmap, func(i, j int) bool {
+		return bitmap[i] < bitmap[j]
+	})
+
+	ttl := soa.Hdr.Ttl
+	if soa.Minttl < ttl {
+		ttl = soa.Minttl
+	}
+
+	return &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		NextDomain: "\\000." + name,
+		TypeBitMap: bitmap,
+	}
+}
+
+// entryTypes returns the types of the addresses of entry
+func entryTypes(entry *Entry) []uint16 {
+	var types []uint16
+	if entry.Value4 != nil {
+		types = append(types, dns.TypeA)
+	}
+	if entry.Value != nil {
+		types = append(types, dns.TypeAAAA)
 	}
+
+	return types
+}
+
+// remoteIP returns the address of the client
+func remoteIP(w dns.ResponseWriter) net.IP {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return normalizeIP(addr.IP)
+	case *net.UDPAddr:
+		return normalizeIP(addr.IP)
+	}
+
+	return nil
 }
 
-func handleDnsRequest(w dns.ResponseWriter, r *dns.Msg, store *Store, config *DNSConfig, s *DNSSECSigner) {
+func handleDnsRequest(w dns.ResponseWriter, r *dns.Msg, store *Store, config *DNSConfig, s *DNSSECSigner, t *zoneTransfer) {
+	if isTransfer(r) {
+		handleTransfer(w, r, store, config, t)
+		return
+	}
+
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.Compress = false
@@ -157,7 +324,10 @@ func handleDnsRequest(w dns.ResponseWriter, r *dns.Msg, store *Store, config *DN
 	switch r.Opcode {
 	case dns.OpcodeQuery:
 		parseDNSQuery(r, m, store, config, s)
+	case dns.OpcodeUpdate:
+		handleUpdate(w, r, m, store)
 	}
+	signReply(w, r, m)
 
 	err := w.WriteMsg(m)
 	if err != nil {
@@ -172,17 +342,70 @@ type DNSSECSigner struct {
 	signer crypto.Signer
 	config *DNSConfig
 	store  *Store
+	// zone is the reverse zone the signer is for, the domain of the store if empty
+	zone string
+	// flags are the flags of the DNSKEY, ZONE and SEP (a KSK) if 0
+	flags uint16
+	// zsk signs all RRsets but the DNSKEY set, if set. The KSK signs everything otherwise.
+	zsk *DNSSECSigner
+}
+
+// origin returns the name of the zone of the signer
+func (s *DNSSECSigner) origin() string {
+	if s.zone != "" {
+		return s.zone
+	}
+
+	return s.store.Domain() + "."
+}
+
+// setup loads key, or generates one if it is empty and logs it to be added to the config at configPath,
+// and the separate zone signing key zsk, if set
+func (s *DNSSECSigner) setup(key string, zsk string, configPath string) error {
+	if key == "" {
+		keyexport, err := s.Generate()
+		if err != nil {
+			return err
+		}
+		log.Printf("No DNSSEC key was provided for %s. Please add the following into your config:\n", s.origin())
+		log.Printf("  %s: \"%s\"\n", configPath, keyexport)
+	} else {
+		err := s.Load(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	if zsk != "" {
+		s.zsk = &DNSSECSigner{
+			config: s.config,
+			store:  s.store,
+			zone:   s.zone,
+			flags:  dns.ZONE,
+		}
+		err := s.zsk.Load(zsk)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("DS Record: %s\n", s.GetDSStr())
+
+	return nil
 }
 
 func (s *DNSSECSigner) setupRecord() {
 	s.d.Hdr = dns.RR_Header{
-		Name:   s.store.Domain() + ".",
+		Name:   s.origin(),
 		Rrtype: dns.TypeDNSKEY,
 		Class:  dns.ClassINET,
 		Ttl:    3600,
 	}
 	s.d.Protocol = 3 // DNSSEC
-	s.d.Flags = 257  // ZONE, SEP
+	s.d.Flags = s.flags
+	if s.d.Flags == 0 {
+		s.d.Flags = dns.ZONE | dns.SEP
+	}
 	s.d.Algorithm = dns.ECDSAP256SHA256
 }
 
@@ -243,13 +466,23 @@ func (s *DNSSECSigner) GetDNSKEY() *dns.DNSKEY {
 	return &s.d
 }
 
+// GetDNSKEYs returns the DNSKEY set of the zone, the KSK and the ZSK if there is one
+func (s *DNSSECSigner) GetDNSKEYs() []dns.RR {
+	rrs := []dns.RR{s.GetDNSKEY()}
+	if s.zsk != nil {
+		rrs = append(rrs, s.zsk.GetDNSKEY())
+	}
+
+	return rrs
+}
+
 func (s *DNSSECSigner) GetDS() *dns.DS {
 	if s.signer == nil {
 		return nil
 	}
 
 	ds := s.d.ToDS(2)
-	ds.Hdr.Name = s.store.Domain() + "."
+	ds.Hdr.Name = s.origin()
 	ds.Hdr.Ttl = uint32((time.Hour * 24 * 30).Seconds())
 
 	return ds
@@ -265,9 +498,14 @@ func (s *DNSSECSigner) GetDSStr() string {
 }
 
 func (s *DNSSECSigner) GetSOA() *dns.SOA {
+	return s.soa(s.store.GetSerial())
+}
+
+// soa returns the SOA of the zone at serial
+func (s *DNSSECSigner) soa(serial uint32) *dns.SOA {
 	soa := new(dns.SOA)
 	soa.Hdr = dns.RR_Header{
-		Name:   s.store.Domain() + ".",
+		Name:   s.origin(),
 		Rrtype: dns.TypeSOA,
 		Class:  dns.ClassINET,
 		Ttl:    3600,
@@ -275,28 +513,31 @@ func (s *DNSSECSigner) GetSOA() *dns.SOA {
 
 	soa.Mbox = s.config.MNAME
 	soa.Ns = s.config.NS[0]
-	soa.Minttl = 3600
-	soa.Refresh = 1
-	soa.Retry = 1
-	soa.Serial = s.store.GetSerial()
-	soa.Expire = 1
+	soa.Minttl = seconds(s.config.SOA.Minimum, DefaultSOAMinimum)
+	soa.Refresh = seconds(s.config.SOA.Refresh, DefaultSOARefresh)
+	soa.Retry = seconds(s.config.SOA.Retry, DefaultSOARetry)
+	soa.Serial = serial
+	soa.Expire = seconds(s.config.SOA.Expire, DefaultSOAExpire)
 
 	return soa
 }
 
+// Sign returns the RRSIG of the RRset rr by the key of s, valid for the TTL of rr with signatureSkew to spare
 func (s *DNSSECSigner) Sign(rr []dns.RR) (*dns.RRSIG, error) {
 	if s.signer == nil {
 		return nil, dns.ErrPrivKey
 	}
 
+	ttl := rr[0].Header().Ttl
+	now := time.Now()
+
 	rrsig := new(dns.RRSIG)
 	rrsig.Algorithm = s.d.Algorithm
 	rrsig.KeyTag = s.d.KeyTag()
-	rrsig.SignerName = s.store.Domain() + "."
-	rrsig.Inception = uint32(time.Now().Unix() - 3600)
-	ttl := rr[0].Header().Ttl
-	rrsig.Expiration = uint32(time.Now().Add(time.Duration(float64(time.Second)*float64(ttl)) + (time.Second * 3600)).Unix())
-	rrsig.Hdr.Ttl = rr[0].Header().Ttl
+	rrsig.SignerName = s.origin()
+	rrsig.Inception = uint32(now.Add(-signatureSkew).Unix())
+	rrsig.Expiration = uint32(now.Add(time.Duration(ttl)*time.Second + signatureSkew).Unix())
+	rrsig.Hdr.Ttl = ttl
 	err := rrsig.Sign(s.signer, rr)
 	if err != nil {
 		return nil, err
@@ -304,42 +545,99 @@ func (s *DNSSECSigner) Sign(rr []dns.RR) (*dns.RRSIG, error) {
 	return rrsig, nil
 }
 
+// rrsetKey identifies the RRset of a record
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+	class  uint16
+}
+
+// SignRRsets returns rrs with each of its RRsets followed by its RRSIG, by the KSK for the DNSKEY set and by the ZSK otherwise
+func (s *DNSSECSigner) SignRRsets(rrs []dns.RR) ([]dns.RR, error) {
+	var keys []rrsetKey
+	rrsets := make(map[rrsetKey][]dns.RR)
+	for _, rr := range rrs {
+		key := rrsetKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype, rr.Header().Class}
+		if _, ok := rrsets[key]; !ok {
+			keys = append(keys, key)
+		}
+		rrsets[key] = append(rrsets[key], rr)
+	}
+
+	var signed []dns.RR
+	for _, key := range keys {
+		signer := s
+		if s.zsk != nil && key.rrtype != dns.TypeDNSKEY {
+			signer = s.zsk
+		}
+
+		rrsig, err := signer.Sign(rrsets[key])
+		if err != nil {
+			return nil, err
+		}
+		signed = append(append(signed, rrsets[key]...), rrsig)
+	}
+
+	return signed, nil
+}
+
 func ProvideDNS(config *DNSConfig, store *Store, ctx context.Context, errChan chan<- error) {
+	if len(config.NS) == 0 {
+		errChan <- ErrNoNS
+		return
+	}
+
 	// prepare dnssec
 	s := &DNSSECSigner{
 		config: config,
 		store:  store,
 	}
-	if config.DNSSECKey == "" {
-		keyexport, err := s.Generate()
-		if err != nil {
-			errChan <- err
-			return
-		}
-		log.Printf("No DNSSEC key was provided. Please add the following into your config:\n")
-		log.Printf("  dnssec_key: \"%s\"\n", keyexport)
-	} else {
-		err := s.Load(config.DNSSECKey)
+	err := s.setup(config.DNSSECKey, config.DNSSECZSK, "dnssec_key")
+	if err != nil {
+		errChan <- err
+		return
+	}
+
+	t, err := newZoneTransfer(&config.Transfer, store.Domain())
+	if err != nil {
+		errChan <- err
+		return
+	}
+
+	for _, allow := range config.Embedded.Allow {
+		_, err := parsePrefix(allow)
 		if err != nil {
 			errChan <- err
 			return
 		}
 	}
 
-	log.Printf("DS Record: %s\n", s.GetDSStr())
-
 	// attach request handler func
 	mux := dns.NewServeMux()
 	mux.HandleFunc(store.Domain()+".", func(w dns.ResponseWriter, r *dns.Msg) {
-		handleDnsRequest(w, r, store, config, s)
+		handleDnsRequest(w, r, store, config, s, t)
 	})
 
+	err = provideReverse(mux, config, store)
+	if err != nil {
+		errChan <- err
+		return
+	}
+
+	tsig := &tsigProvider{
+		transfer: tsigSecrets(&config.Transfer),
+		store:    store,
+	}
+
 	// create servers
 	serverTcp := &dns.Server{
 		Addr:      config.Address + ":" + strconv.Itoa(int(config.Port)),
 		Net:       "tcp",
 		Handler:   mux,
 		ReusePort: true,
+
+		TsigProvider:  tsig,
+		MsgAcceptFunc: acceptMsg,
 	}
 	serverUdp := &dns.Server{
 		Addr:      config.Address + ":" + strconv.Itoa(int(config.Port)),
@@ -347,6 +645,9 @@ func ProvideDNS(config *DNSConfig, store *Store, ctx context.Context, errChan ch
 		Handler:   mux,
 		UDPSize:   65535,
 		ReusePort: true,
+
+		TsigProvider:  tsig,
+		MsgAcceptFunc: acceptMsg,
 	}
 
 	go func() {
@@ -0,0 +1,118 @@
+package lib
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+// signedQuery answers a query with the DO flag for all questions
+func signedQuery(store *Store, config *DNSConfig, s *DNSSECSigner, questions ...dns.Question) *dns.Msg {
+	r := new(dns.Msg)
+	r.Question = questions
+	r.SetEdns0(4096, true)
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Question = questions // SetReply only keeps the first one
+	parseDNSQuery(r, m, store, config, s)
+
+	return m
+}
+
+func TestSignRRsets(t *testing.T) {
+	store := testStore(t, &StoreConfig{
+		TTL: time.Hour,
+	})
+	_, name, err := store.AddEntry(Auth{IP: net.ParseIP("2001:db8::1")}, "")
+	assert.NoError(t, err)
+
+	config := &DNSConfig{
+		MNAME: "example.example.org.",
+		NS:    []string{"ns1.give-me-dns.net.", "ns2.give-me-dns.net."},
+	}
+	s := &DNSSECSigner{config: config, store: store}
+	_, err = s.Generate()
+	assert.NoError(t, err)
+	s.zsk = &DNSSECSigner{config: config, store: store, flags: dns.ZONE}
+	_, err = s.zsk.Generate()
+	assert.NoError(t, err)
+
+	// verify checks that every RRset is followed by its RRSIG by the key with keyTag
+	verify := func(rrs []dns.RR, keyTag uint16, rrtype uint16, count int) {
+		assert.Len(t, rrs, count+1)
+		rrsig := rrs[count].(*dns.RRSIG)
+		assert.Equal(t, rrtype, rrsig.TypeCovered)
+		assert.Equal(t, keyTag, rrsig.KeyTag)
+		assert.Equal(t, rrs[0].Header().Ttl, rrsig.Hdr.Ttl)
+		assert.True(t, rrsig.ValidityPeriod(time.Now().Add(time.Duration(rrsig.Hdr.Ttl)*time.Second)))
+
+		key := s.GetDNSKEY()
+		if keyTag != key.KeyTag() {
+			key = s.zsk.GetDNSKEY()
+		}
+		assert.NoError(t, rrsig.Verify(key, rrs[:count]))
+	}
+
+	// the KSK signs the DNSKEY set, the ZSK everything else
+	m := signedQuery(store, config, s,
+		dns.Question{Name: "give-me-dns.net.", Qtype: dns.TypeDNSKEY, Qclass: dns.ClassINET},
+		dns.Question{Name: "give-me-dns.net.", Qtype: dns.TypeNS, Qclass: dns.ClassINET},
+		dns.Question{Name: name + ".", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+	)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Equal(t, uint16(dns.ZONE|dns.SEP), m.Answer[0].(*dns.DNSKEY).Flags)
+	assert.Equal(t, uint16(dns.ZONE), m.Answer[1].(*dns.DNSKEY).Flags)
+	verify(m.Answer[:3], s.GetDNSKEY().KeyTag(), dns.TypeDNSKEY, 2)
+	verify(m.Answer[3:6], s.zsk.GetDNSKEY().KeyTag(), dns.TypeNS, 2)
+	verify(m.Answer[6:], s.zsk.GetDNSKEY().KeyTag(), dns.TypeAAAA, 1)
+
+	m = signedQuery(store, config, s, dns.Question{Name: name + ".", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	verify(m.Ns[:2], s.zsk.GetDNSKEY().KeyTag(), dns.TypeSOA, 1)
+	verify(m.Ns[2:], s.zsk.GetDNSKEY().KeyTag(), dns.TypeNSEC, 1)
+
+	// answers that can't be signed fail
+	s.zsk.signer = nil
+	m = signedQuery(store, config, s, dns.Question{Name: name + ".", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+	assert.Equal(t, dns.RcodeServerFailure, m.Rcode)
+	assert.Empty(t, m.Answer)
+	assert.Empty(t, m.Ns)
+}
+
+func TestResolveDomainDepth(t *testing.T) {
+	store := testStore(t, &StoreConfig{
+		TTL: time.Hour,
+	})
+	_, name, err := store.AddEntry(Auth{IP: net.ParseIP("192.0.2.1")}, "")
+	assert.NoError(t, err)
+
+	config := &DNSConfig{
+		MNAME: "example.example.org.",
+		NS:    []string{"ns1.give-me-dns.net."},
+	}
+	s := &DNSSECSigner{config: config, store: store}
+
+	query := func(name string) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypeA)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		parseDNSQuery(r, m, store, config, s)
+
+		return m
+	}
+
+	m := query(name + ".")
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Len(t, m.Answer, 1)
+
+	// names below the entries, or below other names, don't exist
+	id := store.ParseID(name)
+	for _, below := range []string{"x." + name + ".", "x.y." + name + ".", id + ".x.give-me-dns.net."} {
+		m = query(below)
+		assert.Equal(t, dns.RcodeNameError, m.Rcode, below)
+		assert.Empty(t, m.Answer, below)
+	}
+}
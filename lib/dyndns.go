@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// FrontendDynDNS is recorded in the history for changes by the dyndns2 protocol
+const FrontendDynDNS = "dyndns"
+
+// The responses of the dyndns2 protocol
+const (
+	DynDNSGood    = "good"
+	DynDNSNoChg   = "nochg"
+	DynDNSBadAuth = "badauth"
+	DynDNSNoHost  = "nohost"
+	DynDNSAbuse   = "abuse"
+	DynDNSDNSErr  = "dnserr"
+	DynDNS911     = "911"
+)
+
+var ErrAddressFamilies = errors.New("names have at most one address of each family")
+
+// dynDNSAddresses parses the comma separated addresses of the myip and myipv6 parameters, at most one of each family
+func dynDNSAddresses(request *http.Request) ([]net.IP, error) {
+	var ips []net.IP
+	families := make(map[int]bool)
+	for _, param := range []string{"myip", "myipv6"} {
+		for _, s := range strings.Split(request.URL.Query().Get(param), ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+
+			ip := normalizeIP(net.ParseIP(s))
+			if ip == nil {
+				return nil, net.InvalidAddrError(s)
+			}
+			if families[len(ip)] {
+				return nil, ErrAddressFamilies
+			}
+			families[len(ip)] = true
+			ips = append(ips, ip)
+		}
+	}
+
+	return ips, nil
+}
+
+// sameAddresses reports whether entry already points to ips
+func sameAddresses(entry *Entry, ips []net.IP) bool {
+	for _, ip := range ips {
+		if !entry.HasIP(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// handleDynDNS adds the /nic/update endpoint of the dyndns2 protocol to mux, authenticating with the name and its token.
+// Each update also renews the name, so clients only updating on address changes keep it.
+func handleDynDNS(mux *http.ServeMux, store *Store, limiter *RateLimiter) {
+	mux.HandleFunc("/nic/update", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		reply := func(status int, response string) {
+			writer.WriteHeader(status)
+			_, _ = fmt.Fprintln(writer, response)
+		}
+
+		user, token, ok := request.BasicAuth()
+		if !ok || token == "" {
+			writer.Header().Set("WWW-Authenticate", `Basic realm="give-me-dns"`)
+			reply(http.StatusUnauthorized, DynDNSBadAuth)
+			return
+		}
+		id := store.ParseID(user)
+
+		if hostname := request.URL.Query().Get("hostname"); hostname != "" && store.ParseID(hostname) != id {
+			reply(http.StatusOK, DynDNSNoHost)
+			return
+		}
+
+		ip, err := getIP(writer, request)
+		if err != nil {
+			reply(http.StatusBadRequest, DynDNS911)
+			return
+		}
+
+		err = limiter.Allow(ip)
+		if err != nil {
+			reply(http.StatusTooManyRequests, DynDNSAbuse)
+			return
+		}
+
+		ips, err := dynDNSAddresses(request)
+		if err != nil {
+			reply(http.StatusBadRequest, DynDNS911)
+			return
+		}
+		if len(ips) == 0 {
+			ips = []net.IP{ip}
+		}
+
+		auth := Auth{IP: ip, Token: token, Frontend: FrontendDynDNS}
+		entry, err := store.ResolveEntry(id)
+		if err == nil && entry == nil {
+			err = ErrNotFound
+		}
+
+		response := DynDNSNoChg
+		if err == nil {
+			if !sameAddresses(entry, ips) {
+				response = DynDNSGood
+			}
+			_, _, err = store.UpdateRenewEntry(id, auth, ips...)
+		}
+
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrNotFound):
+			reply(http.StatusOK, DynDNSNoHost)
+			return
+		case errors.Is(err, ErrNotAllowed):
+			reply(http.StatusOK, DynDNSBadAuth)
+			return
+		case errors.Is(err, ErrAddressInUse):
+			reply(http.StatusOK, DynDNSDNSErr)
+			return
+		default:
+			sentry.CaptureException(err)
+			log.Printf("dyndns update of %s failed: %s\n", id, err)
+			reply(http.StatusInternalServerError, DynDNS911)
+			return
+		}
+
+		addresses := make([]string, len(ips))
+		for i, ip := range ips {
+			addresses[i] = ip.String()
+		}
+		reply(http.StatusOK, response+" "+strings.Join(addresses, ","))
+	})
+}
@@ -0,0 +1,56 @@
+package lib
+
+import (
+	"net"
+	"regexp"
+	"strings"
+)
+
+var embedded4Re = regexp.MustCompile(`^[0-9]{1,3}(-[0-9]{1,3}){3}$`)
+
+// ParseEmbedded decodes an address embedded in a label, with its dots or colons replaced by hyphens
+// (192-0-2-1 or 2001-db8--1), or returns nil if the label doesn't embed one
+func ParseEmbedded(label string) net.IP {
+	if embedded4Re.MatchString(label) {
+		return net.ParseIP(strings.ReplaceAll(label, "-", ".")).To4()
+	}
+
+	if !strings.Contains(label, "-") {
+		return nil
+	}
+	ip := net.ParseIP(strings.ReplaceAll(label, "-", ":"))
+	if ip == nil || ip.To4() != nil { // IPv4-mapped addresses only have one form
+		return nil
+	}
+
+	return ip
+}
+
+// resolveEmbedded returns an entry pointing to the address embedded in label, if embedded names are enabled and the address is allowed
+func resolveEmbedded(label string, config *EmbeddedConfig) *Entry {
+	if !config.Enable {
+		return nil
+	}
+
+	ip := ParseEmbedded(label)
+	if ip == nil {
+		return nil
+	}
+
+	allowed := len(config.Allow) == 0
+	for _, allow := range config.Allow {
+		prefix, err := parsePrefix(allow)
+		if err == nil && prefix.Contains(ip) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil
+	}
+
+	entry := &Entry{}
+	entry.SetIP(ip)
+
+	return entry
+}
@@ -0,0 +1,28 @@
+package lib
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestParseEmbedded(t *testing.T) {
+	assert.Equal(t, net.ParseIP("192.0.2.1").To4(), ParseEmbedded("192-0-2-1"))
+	assert.Equal(t, net.ParseIP("2001:db8::1"), ParseEmbedded("2001-db8--1"))
+	assert.Equal(t, net.ParseIP("::1"), ParseEmbedded("--1"))
+
+	for _, label := range []string{"12345", "my-vanity", "192-0-2-256", "192-0-2", "1-2-3-4-5"} {
+		assert.Nil(t, ParseEmbedded(label), label)
+	}
+
+	config := &EmbeddedConfig{Enable: true, Allow: []string{"2001:db8::/32"}}
+	assert.Equal(t, net.ParseIP("2001:db8::1"), resolveEmbedded("2001-db8--1", config).Value)
+	assert.Nil(t, resolveEmbedded("2001-db9--1", config))
+	assert.Nil(t, resolveEmbedded("192-0-2-1", config))
+	assert.Nil(t, resolveEmbedded("2001-db8--1", &EmbeddedConfig{}))
+
+	// embedded names can't be registered
+	store := testStore(t, &StoreConfig{})
+	assert.True(t, store.IsReserved("2001-db8--1"))
+	assert.False(t, store.IsReserved("my-vanity"))
+}
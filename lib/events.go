@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"net"
+	"time"
+)
+
+// EventType tells what happened to an entry
+type EventType string
+
+const (
+	EventAdded   EventType = "added"
+	EventChanged EventType = "changed"
+	EventRemoved EventType = "removed"
+)
+
+// EventReason tells why it happened
+type EventReason string
+
+const (
+	ReasonRegistered EventReason = "registered"
+	ReasonRenewed    EventReason = "renewed"
+	ReasonRenamed    EventReason = "renamed"
+	ReasonLinked     EventReason = "linked"
+	ReasonUpdated    EventReason = "updated"
+	// ReasonAddressTaken is the reason for entries that lost an address to another entry
+	ReasonAddressTaken EventReason = "address_taken"
+	ReasonReleased     EventReason = "released"
+	ReasonExpired      EventReason = "expired"
+	ReasonImported     EventReason = "imported"
+	// ReasonKeyIssued is the reason for entries that got a new TSIG key, management token or acme-dns account
+	ReasonKeyIssued EventReason = "key_issued"
+	// ReasonChallenge is the reason for entries whose TXT records of the ACME DNS-01 challenges were updated
+	ReasonChallenge EventReason = "challenge"
+)
+
+// Event describes a change of an entry in the zone
+type Event struct {
+	Type   EventType
+	Reason EventReason
+	ID     string
+	// Name is the DNS name of the entry
+	Name string
+	// Entry is the entry after the change, or before it was removed. Its token is never set.
+	Entry Entry
+	// Serial is the serial of the zone after the change
+	Serial uint32
+	Time   time.Time
+	// Client is the address of the client that made the change, nil for changes like expiries
+	Client   net.IP
+	Frontend string
+}
+
+type subscription struct {
+	fn func(event Event)
+}
+
+// Subscribe calls fn with every event after its change was committed, one event at a time and in the order of the changes.
+// fn must not change the store and should hand off slow work, as changes wait for it.
+// The returned function ends the subscription.
+func (s *Store) Subscribe(fn func(event Event)) func() {
+	sub := &subscription{fn: fn}
+
+	s.subscriptionsLock.Lock()
+	s.subscriptions = append(s.subscriptions, sub)
+	s.subscriptionsLock.Unlock()
+
+	return func() {
+		s.subscriptionsLock.Lock()
+		defer s.subscriptionsLock.Unlock()
+
+		for i, other := range s.subscriptions {
+			if other == sub {
+				s.subscriptions = append(s.subscriptions[:i:i], s.subscriptions[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// publish passes events to the subscribers
+func (s *Store) publish(events []Event) {
+	s.subscriptionsLock.Lock()
+	subscriptions := s.subscriptions
+	s.subscriptionsLock.Unlock()
+
+	for _, event := range events {
+		for _, sub := range subscriptions {
+			sub.fn(event)
+		}
+	}
+}
+
+// storeTx is a write transaction of the store, collecting the events of its changes
+type storeTx struct {
+	BackendTx
+	store  *Store
+	auth   Auth
+	events []Event
+	// serial is set by replicas to take over the serial of the primary, instead of incrementing it
+	serial uint32
+}
+
+func (tx *storeTx) emit(typ EventType, reason EventReason, id string, entry *Entry) {
+	event := Event{
+		Type:     typ,
+		Reason:   reason,
+		ID:       id,
+		Name:     id + "." + tx.store.Config.Domain,
+		Entry:    *entry,
+		Time:     time.Now(),
+		Client:   tx.auth.IP,
+		Frontend: tx.auth.Frontend,
+	}
+	event.Entry.Token = ""
+	if reason == ReasonExpired { // even if the client's change removed it
+		event.Client = nil
+		event.Frontend = ""
+	}
+
+	tx.events = append(tx.events, event)
+}
@@ -0,0 +1,147 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// FrontendImport is recorded in the history for imported entries
+const FrontendImport = "import"
+
+// ExportedEntry is an entry as exported, one JSON object per line
+type ExportedEntry struct {
+	ID string `json:"id"`
+	Entry
+}
+
+// Export writes all live entries to w as JSON lines. The TSIG secrets of the entries are only written with secrets,
+// as they are stored in plain, otherwise the imported entries need new keys.
+func (s *Store) Export(w io.Writer, secrets bool) error {
+	encoder := json.NewEncoder(w)
+
+	return s.ForEach(func(name string, entry Entry) error {
+		if !secrets {
+			entry.TSIGSecret = ""
+		}
+
+		return encoder.Encode(&ExportedEntry{
+			ID:    s.ParseID(name),
+			Entry: entry,
+		})
+	})
+}
+
+// ExportZone writes the zone as RFC 1035 zone file to w
+func ExportZone(w io.Writer, config *DNSConfig, store *Store) error {
+	if len(config.NS) == 0 {
+		return ErrNoNS
+	}
+
+	rrs, err := ZoneRRs(config, store)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "$ORIGIN %s.\n", store.Domain())
+	if err != nil {
+		return err
+	}
+
+	for _, rr := range rrs {
+		_, err := fmt.Fprintln(w, rr.String())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Import reads entries in the format of Export from r, replacing existing entries of the same id or addresses.
+// Entries that expired since are skipped. It returns the number of imported entries.
+func (s *Store) Import(r io.Reader) (int, error) {
+	err := s.AssertDB()
+	if err != nil {
+		return 0, err
+	}
+
+	if s.primary != nil {
+		return 0, ErrReplica
+	}
+
+	var entries []ExportedEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry ExportedEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		entry.ID = s.ParseID(entry.ID)
+		err = ValidateName(entry.ID)
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	imported := 0
+	err = s.change(Auth{Frontend: FrontendImport}, func(tx *storeTx) error {
+		imported = 0
+		now := time.Now()
+
+		for _, e := range entries {
+			if e.Expired(now) || len(e.IPs()) == 0 {
+				continue
+			}
+
+			existing, err := tx.GetEntry(e.ID)
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				err := removeEntry(tx, e.ID, existing)
+				if err != nil {
+					return err
+				}
+			}
+
+			entry := e.Entry
+			for _, ip := range entry.HeldIPs() {
+				err := attachIP(tx, e.ID, &entry, ip)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = tx.PutEntry(e.ID, &entry)
+			if err != nil {
+				return err
+			}
+
+			if existing != nil {
+				tx.emit(EventChanged, ReasonImported, e.ID, &entry)
+			} else {
+				tx.emit(EventAdded, ReasonImported, e.ID, &entry)
+			}
+			imported++
+		}
+
+		return nil
+	})
+
+	return imported, err
+}
@@ -0,0 +1,66 @@
+package lib
+
+import (
+	"bytes"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	store := testStore(t, &StoreConfig{TTL: time.Hour})
+
+	ip6 := net.ParseIP("2001:db8::1")
+	ip4 := net.ParseIP("192.0.2.1")
+	entry, name, err := store.AddEntry(Auth{IP: ip6}, "exported")
+	assert.NoError(t, err)
+	code, _, err := store.CreateLink(ip6)
+	assert.NoError(t, err)
+	_, _, err = store.Link(code, Auth{IP: ip4})
+	assert.NoError(t, err)
+
+	_, _, err = store.IssueKey(name, Auth{IP: ip6})
+	assert.NoError(t, err)
+
+	// the TSIG secrets are only exported on request
+	var buf bytes.Buffer
+	assert.NoError(t, store.Export(&buf, false))
+	assert.NotContains(t, buf.String(), "tsig_secret")
+	buf.Reset()
+	assert.NoError(t, store.Export(&buf, true))
+	assert.Contains(t, buf.String(), "tsig_secret")
+
+	rrs, err := ZoneRRs(&DNSConfig{NS: []string{"ns1.give-me-dns.net."}}, store)
+	assert.NoError(t, err)
+	assert.Equal(t, store.GetSerial(), rrs[0].(*dns.SOA).Serial)
+
+	var zone strings.Builder
+	assert.NoError(t, ExportZone(&zone, &DNSConfig{NS: []string{"ns1.give-me-dns.net."}}, store))
+	assert.Contains(t, zone.String(), "$ORIGIN give-me-dns.net.\n")
+	assert.Contains(t, zone.String(), "exported.give-me-dns.net.\t3600\tIN\tAAAA\t2001:db8::1\n")
+	assert.Contains(t, zone.String(), "exported.give-me-dns.net.\t3600\tIN\tA\t192.0.2.1\n")
+
+	other := testStore(t, &StoreConfig{TTL: time.Hour})
+	imported, err := other.Import(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, imported)
+
+	// the reverse index is rebuilt and the expiry and token are kept
+	for _, ip := range []net.IP{ip4, ip6} {
+		importedEntry, importedName, err := other.ResolveIP(ip)
+		assert.NoError(t, err)
+		assert.Equal(t, name, importedName)
+		assert.True(t, entry.Expires.Equal(importedEntry.Expires))
+	}
+
+	_, _, err = other.RenewEntry(name, Auth{IP: net.ParseIP("2001:db8::2"), Token: entry.Token})
+	assert.NoError(t, err)
+
+	_, err = other.Import(strings.NewReader(`{"id":"-bad"}`))
+	assert.ErrorIs(t, err, ErrInvalidName)
+
+	assert.ErrorIs(t, ExportZone(&zone, &DNSConfig{}, store), ErrNoNS)
+}
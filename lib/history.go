@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"net"
+	"time"
+)
+
+const DefaultHistoryRetention = 30 * 24 * time.Hour
+
+// The frontends clients use, recorded in the history
+const (
+	FrontendTCP  = "tcp"
+	FrontendHTTP = "http"
+)
+
+// HistoryRecord is a change of the zone as kept in the history
+type HistoryRecord struct {
+	Time   time.Time   `json:"time"`
+	Action EventReason `json:"action"`
+	Name   string      `json:"name"`
+	// Addresses of the entry after the change, or before it was removed
+	Addresses []net.IP `json:"addresses,omitempty"`
+	// Client is the address of the client that made the change, if it was made by one
+	Client   net.IP `json:"client,omitempty"`
+	Frontend string `json:"frontend,omitempty"`
+}
+
+// matches reports whether the record is about name or about an address within prefix, nil or empty match anything
+func (r *HistoryRecord) matches(name string, prefix *net.IPNet) bool {
+	if name != "" && name != r.Name {
+		return false
+	}
+
+	if prefix == nil {
+		return true
+	}
+
+	for _, ip := range append(r.Addresses, r.Client) {
+		if ip != nil && prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HistoryRetention returns how long the history is kept, 0 if it is disabled
+func (s *Store) HistoryRetention() time.Duration {
+	if s.Config.HistoryRetention < 0 {
+		return 0
+	}
+	if s.Config.HistoryRetention == 0 {
+		return DefaultHistoryRetention
+	}
+
+	return s.Config.HistoryRetention
+}
+
+// record appends events to the history
+func (s *Store) record(tx BackendTx, events []Event) error {
+	if s.HistoryRetention() == 0 {
+		return nil
+	}
+
+	for _, event := range events {
+		err := tx.AppendHistory(&HistoryRecord{
+			Time:      event.Time,
+			Action:    event.Reason,
+			Name:      event.Name,
+			Addresses: event.Entry.IPs(),
+			Client:    event.Client,
+			Frontend:  event.Frontend,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// History returns the records about the DNS name, or about addresses within prefix, oldest first.
+// Records older than the retention are left out, even if they weren't removed yet.
+func (s *Store) History(name string, prefix *net.IPNet) ([]HistoryRecord, error) {
+	var records []HistoryRecord
+
+	err := s.AssertDB()
+	if err != nil {
+		return records, err
+	}
+
+	if name != "" {
+		name = s.ParseID(name) + "." + s.Config.Domain
+	}
+	since := time.Now().Add(-s.HistoryRetention())
+
+	err = s.backend.View(func(tx BackendTx) error {
+		return tx.ForEachHistory(func(record *HistoryRecord) error {
+			if !record.Time.Before(since) && record.matches(name, prefix) {
+				records = append(records, *record)
+			}
+
+			return nil
+		})
+	})
+
+	return records, err
+}
@@ -8,9 +8,11 @@ import (
 	"fmt"
 	"github.com/getsentry/sentry-go"
 	"github.com/hoisie/mustache"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -40,26 +42,69 @@ type JSONReply struct {
 }
 
 type JSONGet struct {
-	HasDNS  bool   `json:"has_dns"`
-	TTL     string `json:"ttl"`
-	DNSName string `json:"dns_name,omitempty"`
-	Expires string `json:"expires,omitempty"`
-	Address net.IP `json:"address"`
+	HasDNS    bool     `json:"has_dns"`
+	TTL       string   `json:"ttl"`
+	DNSName   string   `json:"dns_name,omitempty"`
+	Expires   string   `json:"expires,omitempty"`
+	Address   net.IP   `json:"address"`
+	Addresses []net.IP `json:"addresses,omitempty"`
+	// MaxExpires is the time until which the name can be renewed
+	MaxExpires string `json:"max_expires,omitempty"`
+	// Token is the management token, only returned right after it was issued
+	Token string `json:"token,omitempty"`
 }
 
-func getIP(w http.ResponseWriter, req *http.Request) (net.IP, error) {
-	forward := req.Header.Get("X-Forwarded-For")
-	if forward != "" {
-		ips := strings.Split(forward, ",")
-		ip := ips[0]
-		parsed := net.ParseIP(ip)
-		if parsed == nil {
-			return nil, net.InvalidAddrError(ip)
-		}
+type JSONLink struct {
+	Code    string `json:"code"`
+	Expires string `json:"expires"`
+}
 
-		return parsed, nil
+type JSONRequest struct {
+	Code  string `json:"code,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Token string `json:"token,omitempty"`
+}
+
+// readJSONRequest parses the optional JSON body of a request
+func readJSONRequest(request *http.Request) (*JSONRequest, error) {
+	req := &JSONRequest{}
+	if request.Body == nil {
+		return req, nil
 	}
 
+	err := json.NewDecoder(io.LimitReader(request.Body, 4096)).Decode(req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// sameSite reports whether request was sent from a page of this server by its Origin, or else Referer header.
+// Requests with neither come from clients other than browsers, which can't be made to send them by other sites.
+func sameSite(request *http.Request) bool {
+	source := request.Header.Get("Origin")
+	if source == "" {
+		source = request.Header.Get("Referer")
+	}
+	if source == "" {
+		return true
+	}
+
+	u, err := url.Parse(source)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, request.Host)
+}
+
+// clientIPKey is the context key of the client address, see withClientIP
+type clientIPKey struct{}
+
+// clientIP returns the address of the client of req. X-Forwarded-For is only used if the remote address is one of
+// the trusted proxies, then the client is the last forwarded address that isn't one of them.
+func clientIP(req *http.Request, proxies []*net.IPNet) (net.IP, error) {
 	ip, _, err := net.SplitHostPort(req.RemoteAddr)
 	if err != nil {
 		return nil, net.InvalidAddrError(req.RemoteAddr)
@@ -70,37 +115,165 @@ func getIP(w http.ResponseWriter, req *http.Request) (net.IP, error) {
 		return nil, net.InvalidAddrError(ip)
 	}
 
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && containsIP(proxies, parsed); i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if ip == "" {
+			continue
+		}
+
+		parsed = net.ParseIP(ip)
+		if parsed == nil {
+			return nil, net.InvalidAddrError(ip)
+		}
+	}
+
 	return parsed, nil
 }
 
+// containsIP reports whether ip is within one of prefixes
+func containsIP(prefixes []*net.IPNet, ip net.IP) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withClientIP resolves the client address of each request for getIP, trusting the X-Forwarded-For of proxies
+func withClientIP(proxies []*net.IPNet, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ip, err := clientIP(request, proxies)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			jsonResponse(JSONReply{
+				Err: FailedToGetInfo,
+			}, writer)
+			return
+		}
+
+		handler.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), clientIPKey{}, ip)))
+	})
+}
+
+// getIP returns the client address resolved by withClientIP, or the remote address without it
+func getIP(w http.ResponseWriter, req *http.Request) (net.IP, error) {
+	if ip, ok := req.Context().Value(clientIPKey{}).(net.IP); ok {
+		return ip, nil
+	}
+
+	return clientIP(req, nil)
+}
+
 func getInfo(w http.ResponseWriter, req *http.Request, store *Store) (*JSONGet, error) {
 	ip, err := getIP(w, req)
 	if err != nil {
 		return nil, err
 	}
 
+	entry, id, err := store.ResolveIP(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	return entryInfo(ip, entry, id, store), nil
+}
+
+func entryInfo(ip net.IP, entry Entry, id string, store *Store) *JSONGet {
 	info := &JSONGet{
 		Address: ip,
 		TTL:     store.Config.TTL.String(),
 	}
 
-	entry, id, err := store.ResolveIP(ip)
-	if err != nil {
-		return nil, err
-	}
 	if id != "" {
 		info.HasDNS = true
 		info.Expires = entry.Expires.Format(time.RFC3339)
 		info.DNSName = id
+		info.Addresses = entry.IPs()
+		info.Token = entry.Token
+		if maxExpires := store.MaxExpires(entry); !maxExpires.IsZero() {
+			info.MaxExpires = maxExpires.Format(time.RFC3339)
+		}
+	}
+
+	return info
+}
+
+// errorStatus maps store errors to the HTTP status reported to the client
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidName):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrNoEntry), errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrNotAllowed), errors.Is(err, ErrInvalidLink):
+		return http.StatusForbidden
+	case errors.Is(err, ErrMaxLifetime), errors.Is(err, ErrAddressInUse):
+		return http.StatusConflict
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusForbidden
+	}
+
+	return http.StatusInternalServerError
+}
+
+// jsonStoreError replies with the error of a store operation, internal errors are reported as failed
+func jsonStoreError(err error, failed string, writer http.ResponseWriter) {
+	status := errorStatus(err)
+	msg := err.Error()
+	if status == http.StatusInternalServerError {
+		sentry.CaptureException(err)
+		log.Printf("HTTP err: %s\n", err)
+		msg = failed
 	}
 
-	return info, err
+	writer.WriteHeader(status)
+	jsonResponse(JSONReply{
+		Err: msg,
+	}, writer)
 }
 
 const FailedToGetInfo = "Failed to get information about client"
 const FailedToAddEntry = "Failed to add entry"
+const FailedToParseRequest = "Failed to parse request"
+const FailedToLinkEntry = "Failed to link entry"
+const FailedToRenewEntry = "Failed to renew entry"
+const FailedToReleaseEntry = "Failed to release entry"
+const FailedToUpdateEntry = "Failed to update entry"
+
+// rateLimited applies the rate limits to all requests that change something, except for those exempt returns true for
+func rateLimited(limiter *RateLimiter, exempt func(request *http.Request) bool, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != "GET" && request.Method != "HEAD" && !exempt(request) {
+			ip, err := getIP(writer, request)
+			if err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				jsonResponse(JSONReply{
+					Err: FailedToGetInfo,
+				}, writer)
+				return
+			}
+
+			err = limiter.Allow(ip)
+			var rateErr *RateLimitError
+			if errors.As(err, &rateErr) {
+				writer.Header().Set("Retry-After", strconv.Itoa(int(rateErr.RetryAfter.Seconds())+1))
+			}
+			if err != nil {
+				jsonStoreError(err, FailedToGetInfo, writer)
+				return
+			}
+		}
+
+		handler.ServeHTTP(writer, request)
+	})
+}
 
-func ProvideHTTP(config *HTTPConfig, store *Store, ctx context.Context, errChan chan<- error) {
+func ProvideHTTP(config *HTTPConfig, store *Store, limiter *RateLimiter, ctx context.Context, errChan chan<- error) {
 	file, err := assetFS.ReadFile("index.html")
 	if err != nil {
 		errChan <- err
@@ -113,18 +286,45 @@ func ProvideHTTP(config *HTTPConfig, store *Store, ctx context.Context, errChan
 		return
 	}
 
+	var proxies []*net.IPNet
+	for _, proxy := range config.TrustedProxies {
+		prefix, err := parsePrefix(proxy)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		proxies = append(proxies, prefix)
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
+		token := ""
 		if request.Method == "POST" {
+			// the form manages the name of the visitor's address, which other sites must not submit it for
+			if !sameSite(request) {
+				writer.WriteHeader(http.StatusForbidden)
+				return
+			}
+
 			ip, err := getIP(writer, request)
 			if err != nil {
 				writer.WriteHeader(http.StatusBadRequest)
 				return
 			}
 
-			_, _, err = store.AddEntry(ip)
+			auth := Auth{IP: ip, Token: request.FormValue("token"), Frontend: FrontendHTTP}
+			switch request.FormValue("action") {
+			case "renew":
+				_, _, err = store.RenewEntry(request.FormValue("name"), auth)
+			case "release":
+				_, err = store.DeleteEntry(request.FormValue("name"), auth)
+			default:
+				var entry Entry
+				entry, _, err = store.AddEntry(auth, request.FormValue("name"))
+				token = entry.Token
+			}
 			if err != nil {
-				writer.WriteHeader(http.StatusInternalServerError)
+				writer.WriteHeader(errorStatus(err))
 				return
 			}
 		}
@@ -139,6 +339,7 @@ func ProvideHTTP(config *HTTPConfig, store *Store, ctx context.Context, errChan
 					Err: FailedToGetInfo,
 				}))
 			} else {
+				info.Token = token
 				fmt.Fprint(writer, template.Render(&JSONReply{
 					Res: info,
 					OK:  true,
@@ -149,47 +350,158 @@ func ProvideHTTP(config *HTTPConfig, store *Store, ctx context.Context, errChan
 		}
 	})
 	mux.HandleFunc("/json", func(writer http.ResponseWriter, request *http.Request) {
-		if request.Method == "POST" {
-			ip, err := getIP(writer, request)
+		if request.Method == "GET" {
+			info, err := getInfo(writer, request, store)
 			if err != nil {
-				writer.WriteHeader(http.StatusBadRequest)
 				jsonResponse(JSONReply{
 					Err: FailedToGetInfo,
 				}, writer)
 				return
 			}
 
-			_, _, err = store.AddEntry(ip)
-			if err != nil {
-				writer.WriteHeader(http.StatusInternalServerError)
+			jsonResponse(JSONReply{
+				OK:  true,
+				Res: info,
+			}, writer)
+			return
+		}
+
+		ip, err := getIP(writer, request)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			jsonResponse(JSONReply{
+				Err: FailedToGetInfo,
+			}, writer)
+			return
+		}
+
+		req, err := readJSONRequest(request)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			jsonResponse(JSONReply{
+				Err: FailedToParseRequest,
+			}, writer)
+			return
+		}
+
+		auth := Auth{IP: ip, Token: req.Token, Frontend: FrontendHTTP}
+		var entry Entry
+		var id string
+		var failed string
+
+		switch request.Method {
+		case "POST":
+			entry, id, err = store.AddEntry(auth, req.Name)
+			failed = FailedToAddEntry
+		case "PUT":
+			entry, id, err = store.RenewEntry(req.Name, auth)
+			failed = FailedToRenewEntry
+		case "PATCH":
+			entry, id, err = store.UpdateEntry(req.Name, auth, ip)
+			failed = FailedToUpdateEntry
+		case "DELETE":
+			_, err = store.DeleteEntry(req.Name, auth)
+			failed = FailedToReleaseEntry
+		default:
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err != nil {
+			jsonStoreError(err, failed, writer)
+			return
+		}
+
+		jsonResponse(JSONReply{
+			OK:  true,
+			Res: entryInfo(ip, entry, id, store),
+		}, writer)
+	})
+
+	mux.HandleFunc("/json/link", func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != "POST" {
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		ip, err := getIP(writer, request)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			jsonResponse(JSONReply{
+				Err: FailedToGetInfo,
+			}, writer)
+			return
+		}
+
+		req, err := readJSONRequest(request)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			jsonResponse(JSONReply{
+				Err: FailedToParseRequest,
+			}, writer)
+			return
+		}
+
+		if req.Code == "" {
+			code, expires, err := store.CreateLink(ip)
+			if errors.Is(err, ErrNoEntry) {
+				writer.WriteHeader(http.StatusNotFound)
 				jsonResponse(JSONReply{
-					Err: FailedToAddEntry,
+					Err: err.Error(),
 				}, writer)
 				return
 			}
-		}
-
-		if request.Method == "GET" || request.Method == "POST" {
-			info, err := getInfo(writer, request, store)
 			if err != nil {
+				sentry.CaptureException(err)
+				writer.WriteHeader(http.StatusInternalServerError)
 				jsonResponse(JSONReply{
-					Err: FailedToGetInfo,
+					Err: FailedToLinkEntry,
 				}, writer)
 				return
 			}
 
 			jsonResponse(JSONReply{
-				OK:  true,
-				Res: info,
+				OK: true,
+				Res: &JSONLink{
+					Code:    code,
+					Expires: expires.Format(time.RFC3339),
+				},
 			}, writer)
-		} else {
-			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		_, _, err = store.Link(req.Code, Auth{IP: ip, Frontend: FrontendHTTP})
+		if err != nil {
+			jsonStoreError(err, FailedToLinkEntry, writer)
+			return
+		}
+
+		info, err := getInfo(writer, request, store)
+		if err != nil {
+			jsonResponse(JSONReply{
+				Err: FailedToGetInfo,
+			}, writer)
+			return
 		}
+
+		jsonResponse(JSONReply{
+			OK:  true,
+			Res: info,
+		}, writer)
 	})
 
+	handleAdmin(mux, config, store)
+	handleDynDNS(mux, store, limiter)
+	handleACME(mux, store)
+	handleReplication(mux, store)
+
+	replica := func(request *http.Request) bool {
+		return replicaRequest(store, request)
+	}
+
 	server := &http.Server{
 		Addr:    config.Address + ":" + strconv.Itoa(int(config.Port)),
-		Handler: mux,
+		Handler: withClientIP(proxies, rateLimited(limiter, replica, mux)),
 	}
 
 	go func() {
@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedForwarded(t *testing.T) {
+	limiter, err := ProvideRateLimiter(&RateLimitConfig{
+		Rules: []RateLimitRule{{Requests: 2, Interval: time.Minute}},
+	}, nil)
+	assert.NoError(t, err)
+	_, proxy, _ := net.ParseCIDR("192.0.2.1/32")
+	exempt := func(request *http.Request) bool {
+		return request.URL.Path == "/exempt"
+	}
+	handler := withClientIP([]*net.IPNet{proxy}, rateLimited(limiter, exempt, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})))
+
+	post := func(remoteAddr string, forwarded string) int {
+		req := httptest.NewRequest("POST", "/json", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", forwarded)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	// untrusted clients are limited by their own address, whatever they forward
+	assert.Equal(t, http.StatusOK, post("198.51.100.1:1234", "203.0.113.1"))
+	assert.Equal(t, http.StatusOK, post("198.51.100.1:1234", "203.0.113.2"))
+	assert.Equal(t, http.StatusTooManyRequests, post("198.51.100.1:1234", "203.0.113.3"))
+
+	// the clients of proxies by the forwarded address
+	assert.Equal(t, http.StatusOK, post("192.0.2.1:1234", "203.0.113.1"))
+	assert.Equal(t, http.StatusOK, post("192.0.2.1:1234", "203.0.113.2"))
+	assert.Equal(t, http.StatusBadRequest, post("192.0.2.1:1234", "invalid"))
+
+	// only exempt requests aren't limited
+	req := httptest.NewRequest("POST", "/exempt", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestSameSite(t *testing.T) {
+	request := func(header string, value string) *http.Request {
+		req := httptest.NewRequest("POST", "http://give-me-dns.net/", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+
+		return req
+	}
+
+	assert.True(t, sameSite(request("", "")))
+	assert.True(t, sameSite(request("Origin", "https://give-me-dns.net")))
+	assert.True(t, sameSite(request("Referer", "https://give-me-dns.net/")))
+	assert.False(t, sameSite(request("Origin", "https://example.org")))
+	assert.False(t, sameSite(request("Origin", "null")))
+	assert.False(t, sameSite(request("Referer", "https://example.org/give-me-dns.net")))
+}
@@ -13,7 +13,7 @@ func ProvideRandomID(IDLen int16) *RandomID {
 }
 
 func (p *RandomID) GetID() (string, error) {
-	id, err := uuid.NewUUID()
+	id, err := uuid.NewRandom()
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,49 @@
+package lib
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var ErrInvalidName = errors.New("invalid name, use 1-63 letters, digits and hyphens, not starting or ending with a hyphen")
+
+// DefaultReservedNames can't be requested by clients, in addition to the reserved names of the config
+var DefaultReservedNames = []string{"www", "ns", "ns1", "ns2", "ns3", "ns4", "mail", "smtp", "imap", "pop", "mx", "admin", "root", "api", "localhost"}
+
+var nameRe = regexp.MustCompile("^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$")
+
+// ValidateName checks that name is a DNS label clients may request
+func ValidateName(name string) error {
+	if !nameRe.MatchString(name) {
+		return ErrInvalidName
+	}
+
+	// labels with hyphens in the 3rd and 4th position are reserved for IDNA (xn--) and the like
+	if len(name) >= 4 && name[2:4] == "--" {
+		return ErrInvalidName
+	}
+
+	return nil
+}
+
+// IsReserved reports whether name can't be requested, as it is reserved or embeds an address
+func (s *Store) IsReserved(name string) bool {
+	if ParseEmbedded(name) != nil {
+		return true
+	}
+
+	for _, reserved := range DefaultReservedNames {
+		if name == reserved {
+			return true
+		}
+	}
+
+	for _, reserved := range s.Config.Reserved {
+		if name == strings.ToLower(reserved) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,9 +1,12 @@
 package lib
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/getsentry/sentry-go"
+	"io"
 	"log"
 	"net"
 	"strconv"
@@ -11,7 +14,186 @@ import (
 	"time"
 )
 
-func ProvideNet(config *NetConfig, store *Store, ctx context.Context, errChan chan<- error) {
+const DefaultReadTimeout = 1 * time.Second
+
+const netHelp = `Commands:
+  ADD [name]              Register a DNS name for this address (default), optionally asking for a specific name
+  <name>                  Same as ADD <name>
+  LINK                    Get a code to attach another address to your DNS name
+  LINK <code>             Attach this address to the DNS name the code was issued for
+  RENEW [name [token]]    Extend the expiry of your DNS name
+  RELEASE [name [token]]  Remove your DNS name
+  UPDATE <name> <token>   Point your DNS name to this address
+  TOKEN [name [token]]    Issue a new management token for your DNS name
+  KEY [name [token]]      Issue a TSIG key to update your DNS name with DNS UPDATE (nsupdate)
+  HELP                    Show this help
+`
+
+func formatNetEntry(entry Entry, dnsName string, store *Store) string {
+	var b strings.Builder
+	for _, ip := range entry.IPs() {
+		fmt.Fprintf(&b, "Address: %s\n", ip)
+	}
+	fmt.Fprintf(&b, "DNS Name: %s\nValid for %s\nExpires %s\n", dnsName, time.Until(entry.Expires).Round(time.Second).String(), entry.Expires.Format(time.RFC3339))
+	if maxExpires := store.MaxExpires(entry); !maxExpires.IsZero() {
+		fmt.Fprintf(&b, "Renewable until %s\n", maxExpires.Format(time.RFC3339))
+	}
+	if entry.Token != "" {
+		fmt.Fprintf(&b, "Token: %s\nKeep the token secret, it manages your DNS name from any address and is only shown once\n", entry.Token)
+	}
+
+	return b.String()
+}
+
+// netAuth reads the optional name and token arguments of a command
+func netAuth(remoteAddr net.IP, args []string) (string, Auth) {
+	name := ""
+	auth := Auth{IP: remoteAddr, Frontend: FrontendTCP}
+	if len(args) > 0 {
+		name = args[0]
+	}
+	if len(args) > 1 {
+		auth.Token = args[1]
+	}
+
+	return name, auth
+}
+
+// netErrorMessage describes an error of the store to the client, action is what was attempted
+func netErrorMessage(err error, action string) string {
+	switch {
+	case errors.Is(err, ErrNoEntry):
+		return "No DNS name registered for this address.\n"
+	case errors.Is(err, ErrNotFound):
+		return "No such DNS name.\n"
+	case errors.Is(err, ErrNotAllowed):
+		return fmt.Sprintf("Not allowed to %s this DNS name, use its token or one of its addresses.\n", action)
+	case errors.Is(err, ErrMaxLifetime):
+		return "DNS name reached its maximum lifetime.\n"
+	case errors.Is(err, ErrInvalidLink):
+		return "Invalid or expired link code.\n"
+	case errors.Is(err, ErrAddressInUse):
+		return "Address is in use by another DNS name.\n"
+	case errors.Is(err, ErrInvalidName):
+		return "Invalid name, use 1-63 letters, digits and hyphens, not starting or ending with a hyphen.\n"
+	case errors.Is(err, ErrRateLimited), errors.Is(err, ErrQuotaExceeded):
+		msg := err.Error()
+		return strings.ToUpper(msg[:1]) + msg[1:] + ".\n"
+	}
+
+	sentry.CaptureException(err)
+	log.Printf("Failed to %s entry: %s", action, err)
+	return fmt.Sprintf("Failed to %s entry.\n", action)
+}
+
+func handleNetCommand(store *Store, limiter *RateLimiter, remoteAddr net.IP, line string) string {
+	fields := strings.Fields(line)
+	cmd := ""
+	var args []string
+	if len(fields) > 0 {
+		cmd = strings.ToUpper(fields[0])
+		args = fields[1:]
+	}
+
+	switch cmd {
+	case "", "ADD":
+		name := ""
+		if len(args) > 0 {
+			name = args[0]
+		}
+
+		entry, dnsName, err := store.AddEntry(Auth{IP: remoteAddr, Frontend: FrontendTCP}, name)
+		if err != nil {
+			return netErrorMessage(err, "add")
+		}
+
+		log.Printf("New entry %s - IP %s\n", dnsName, remoteAddr)
+		res := formatNetEntry(entry, dnsName, store)
+		if name != "" && store.ParseID(dnsName) != store.ParseID(name) {
+			res = fmt.Sprintf("The name %s is not available\n", name) + res
+		}
+
+		return res
+	case "LINK":
+		if len(args) == 0 {
+			code, expires, err := store.CreateLink(remoteAddr)
+			if err != nil {
+				return netErrorMessage(err, "link")
+			}
+
+			return fmt.Sprintf("Link code: %s\nExpires %s\nSend \"LINK %s\" from your other address\n", code, expires.Format(time.RFC3339), code)
+		}
+
+		entry, dnsName, err := store.Link(args[0], Auth{IP: remoteAddr, Frontend: FrontendTCP})
+		if err != nil {
+			return netErrorMessage(err, "link")
+		}
+
+		log.Printf("Linked entry %s - IP %s\n", dnsName, remoteAddr)
+		return formatNetEntry(entry, dnsName, store)
+	case "RENEW":
+		entry, dnsName, err := store.RenewEntry(netAuth(remoteAddr, args))
+		if err != nil {
+			return netErrorMessage(err, "renew")
+		}
+
+		log.Printf("Renewed entry %s - IP %s\n", dnsName, remoteAddr)
+		return formatNetEntry(entry, dnsName, store)
+	case "RELEASE":
+		dnsName, err := store.DeleteEntry(netAuth(remoteAddr, args))
+		if err != nil {
+			return netErrorMessage(err, "release")
+		}
+
+		log.Printf("Released entry %s - IP %s\n", dnsName, remoteAddr)
+		return fmt.Sprintf("Released %s\n", dnsName)
+	case "UPDATE":
+		if len(args) != 2 {
+			return "Usage: UPDATE <name> <token>\n"
+		}
+
+		name, auth := netAuth(remoteAddr, args)
+		entry, dnsName, err := store.UpdateEntry(name, auth, remoteAddr)
+		if err != nil {
+			return netErrorMessage(err, "update")
+		}
+
+		log.Printf("Updated entry %s - IP %s\n", dnsName, remoteAddr)
+		return formatNetEntry(entry, dnsName, store)
+	case "TOKEN":
+		entry, dnsName, err := store.ResetToken(netAuth(remoteAddr, args))
+		if err != nil {
+			return netErrorMessage(err, "reset token of")
+		}
+
+		log.Printf("Reset token of entry %s - IP %s\n", dnsName, remoteAddr)
+		return formatNetEntry(entry, dnsName, store)
+	case "KEY":
+		entry, dnsName, err := store.IssueKey(netAuth(remoteAddr, args))
+		if err != nil {
+			return netErrorMessage(err, "issue a key for")
+		}
+
+		log.Printf("Issued key of entry %s - IP %s\n", dnsName, remoteAddr)
+		return formatNetEntry(entry, dnsName, store) +
+			fmt.Sprintf("TSIG key: hmac-sha256:%s.:%s\nKeep the key secret, it updates the addresses of your DNS name with DNS UPDATE (like nsupdate -y) and is only shown once\n", dnsName, entry.TSIGSecret)
+	case "HELP":
+		return netHelp
+	default:
+		if len(fields) == 1 {
+			return handleNetCommand(store, limiter, remoteAddr, "ADD "+fields[0])
+		}
+	}
+
+	return "Unknown command, send HELP for a list of commands\n"
+}
+
+func ProvideNet(config *NetConfig, store *Store, limiter *RateLimiter, ctx context.Context, errChan chan<- error) {
+	readTimeout := config.ReadTimeout
+	if readTimeout == 0 {
+		readTimeout = DefaultReadTimeout
+	}
+
 	go func() {
 		listen, err := net.Listen("tcp", config.Address+":"+strconv.Itoa(int(config.Port)))
 		if err != nil {
@@ -44,24 +226,24 @@ func ProvideNet(config *NetConfig, store *Store, ctx context.Context, errChan ch
 					}
 				}(conn)
 
-				responseStr := func() string {
-					remoteAddr := conn.RemoteAddr().(*net.TCPAddr).IP
-					if len(remoteAddr) == 4 || strings.Contains(remoteAddr.String(), ".") {
-						return "IPv4 not supported\n"
-					}
+				remoteAddr := conn.RemoteAddr().(*net.TCPAddr).IP
 
-					entry, dnsName, err := store.AddEntry(remoteAddr)
-					if err != nil {
-						sentry.CaptureException(err)
-						log.Printf("Failed to add entry: %s", err)
-						return "Failed to add entry.\n"
-					}
+				// clients that don't send a command within the timeout just get a name
+				err := conn.SetReadDeadline(time.Now().Add(readTimeout))
+				if err != nil {
+					sentry.CaptureException(err)
+					return
+				}
+				line, _ := bufio.NewReader(io.LimitReader(conn, 1024)).ReadString('\n')
 
-					log.Printf("New entry %s - IP %s\n", dnsName, remoteAddr)
-					return fmt.Sprintf("Address: %s\nDNS Name: %s\nValid for %s\nExpires %s\n", remoteAddr, dnsName, store.TTL().String(), entry.Expires.Format(time.RFC3339))
-				}()
+				response := ""
+				if err := limiter.Allow(remoteAddr); err != nil {
+					response = netErrorMessage(err, "handle")
+				} else {
+					response = handleNetCommand(store, limiter, remoteAddr, line)
+				}
 
-				_, err := conn.Write([]byte(responseStr))
+				_, err = conn.Write([]byte(response))
 				if err != nil {
 					sentry.CaptureException(err)
 				}
@@ -0,0 +1,156 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrUnknownNotifyKey = errors.New("notify_key is not one of the tsig_keys")
+
+const DefaultNotifyDelay = 5 * time.Second
+
+// notifyAttempts is how often a NOTIFY is sent until a secondary acknowledges it
+const notifyAttempts = 5
+
+// notifyRetryDelay is the wait before the first retry of a NOTIFY, doubling with each further one
+const notifyRetryDelay = 1 * time.Second
+
+type notifier struct {
+	config  *DNSConfig
+	store   *Store
+	targets []string
+	client  *dns.Client
+	key     string
+	// retryDelay is notifyRetryDelay, shorter in tests
+	retryDelay time.Duration
+}
+
+// ProvideNotify sends a NOTIFY (RFC 1996) to the secondaries of config.Transfer.Notify when the zone changes.
+// Changes within NotifyDelay are collected into a single NOTIFY.
+func ProvideNotify(config *DNSConfig, store *Store, ctx context.Context, errChan chan<- error) {
+	if len(config.Transfer.Notify) == 0 {
+		return
+	}
+
+	n := &notifier{
+		config:     config,
+		store:      store,
+		client:     new(dns.Client),
+		retryDelay: notifyRetryDelay,
+	}
+
+	for _, target := range config.Transfer.Notify {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(target, "53")
+		}
+		n.targets = append(n.targets, target)
+	}
+
+	if config.Transfer.NotifyKey != "" {
+		n.key = dns.Fqdn(strings.ToLower(config.Transfer.NotifyKey))
+		n.client.TsigSecret = tsigSecrets(&config.Transfer)
+		if _, ok := n.client.TsigSecret[n.key]; !ok {
+			errChan <- ErrUnknownNotifyKey
+			return
+		}
+	}
+
+	changed := make(chan struct{}, 1)
+	unsubscribe := store.Subscribe(func(event Event) {
+		select {
+		case changed <- struct{}{}:
+		default: // a NOTIFY is pending already
+		}
+	})
+
+	go func() {
+		defer unsubscribe()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(n.delay()):
+			}
+
+			n.notifyAll(ctx)
+		}
+	}()
+}
+
+func (n *notifier) delay() time.Duration {
+	if n.config.Transfer.NotifyDelay == 0 {
+		return DefaultNotifyDelay
+	}
+
+	return n.config.Transfer.NotifyDelay
+}
+
+// notifyAll notifies all secondaries of the current SOA
+func (n *notifier) notifyAll(ctx context.Context) {
+	s := &DNSSECSigner{
+		config: n.config,
+		store:  n.store,
+	}
+	soa := s.GetSOA()
+
+	var wg sync.WaitGroup
+	for _, target := range n.targets {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			n.notify(ctx, target, soa)
+		}(target)
+	}
+	wg.Wait()
+}
+
+// notify sends a NOTIFY to target until it is acknowledged, waiting longer after each failed attempt
+func (n *notifier) notify(ctx context.Context, target string, soa *dns.SOA) {
+	var err error
+	delay := n.retryDelay
+	for attempt := 0; attempt < notifyAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+
+		m := new(dns.Msg)
+		m.SetNotify(soa.Hdr.Name)
+		m.Answer = []dns.RR{soa}
+		if n.key != "" {
+			m.SetTsig(n.key, dns.HmacSHA256, 300, time.Now().Unix())
+		}
+
+		var r *dns.Msg
+		r, _, err = n.client.Exchange(m, target)
+		if err != nil {
+			continue
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			log.Printf("NOTIFY of serial %d refused by %s: %s\n", soa.Serial, target, dns.RcodeToString[r.Rcode])
+			return
+		}
+
+		log.Printf("Notified %s of serial %d\n", target, soa.Serial)
+		return
+	}
+
+	log.Printf("Failed to notify %s of serial %d: %s\n", target, soa.Serial, err)
+}
@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	store := testStore(t, &StoreConfig{
+		TTL: time.Hour,
+	})
+
+	notifies := make(chan *dns.Msg, 10)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	secondary := &dns.Server{
+		PacketConn: conn,
+		TsigSecret: map[string]string{"notify.": "c2VjcmV0"},
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			assert.Equal(t, dns.OpcodeNotify, r.Opcode)
+			assert.NotNil(t, r.IsTsig())
+			assert.NoError(t, w.TsigStatus())
+			notifies <- r
+
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.SetTsig("notify.", dns.HmacSHA256, 300, time.Now().Unix())
+			assert.NoError(t, w.WriteMsg(m))
+		}),
+	}
+	go func() {
+		_ = secondary.ActivateAndServe()
+	}()
+	defer func() {
+		assert.NoError(t, secondary.Shutdown())
+	}()
+
+	config := &DNSConfig{
+		MNAME: "example.example.org.",
+		NS:    []string{"ns1.give-me-dns.net."},
+		Transfer: TransferConfig{
+			TSIGKeys:    map[string]string{"notify": "c2VjcmV0"},
+			Notify:      []string{conn.LocalAddr().String()},
+			NotifyDelay: 100 * time.Millisecond,
+			NotifyKey:   "notify",
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ProvideNotify(config, store, ctx, nil)
+
+	// changes within the delay are sent as one NOTIFY
+	for i := 1; i <= 3; i++ {
+		_, _, err := store.AddEntry(Auth{IP: net.IPv4(192, 0, 2, byte(i))}, "")
+		assert.NoError(t, err)
+	}
+
+	select {
+	case r := <-notifies:
+		assert.Equal(t, "give-me-dns.net.", r.Question[0].Name)
+		assert.Equal(t, store.GetSerial(), r.Answer[0].(*dns.SOA).Serial)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no NOTIFY sent")
+	}
+
+	select {
+	case <-notifies:
+		t.Fatal("changes were not debounced")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestNotifyRetry(t *testing.T) {
+	store := testStore(t, &StoreConfig{
+		TTL: time.Hour,
+	})
+
+	// the first NOTIFY is lost
+	received := make(chan time.Time, 10)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	secondary := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			received <- time.Now()
+			if len(received) == 1 {
+				return
+			}
+
+			m := new(dns.Msg)
+			m.SetReply(r)
+			assert.NoError(t, w.WriteMsg(m))
+		}),
+	}
+	go func() {
+		_ = secondary.ActivateAndServe()
+	}()
+	defer func() {
+		assert.NoError(t, secondary.Shutdown())
+	}()
+
+	n := &notifier{
+		config: &DNSConfig{
+			MNAME: "example.example.org.",
+			NS:    []string{"ns1.give-me-dns.net."},
+		},
+		store:      store,
+		targets:    []string{conn.LocalAddr().String()},
+		client:     &dns.Client{Timeout: 50 * time.Millisecond},
+		retryDelay: 200 * time.Millisecond,
+	}
+	n.notifyAll(context.Background())
+
+	// the retry waits for retryDelay after the timeout
+	assert.Len(t, received, 2)
+	first, retry := <-received, <-received
+	assert.GreaterOrEqual(t, retry.Sub(first), 250*time.Millisecond)
+}
@@ -0,0 +1,207 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = errors.New("too many requests")
+var ErrQuotaExceeded = errors.New("too many addresses registered")
+var ErrInvalidRatePrefix = errors.New("rate_limit rules need prefix4 within 0-32 and prefix6 within 0-128")
+
+type RateLimitError struct {
+	Prefix     *net.IPNet
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("too many requests from %s, try again in %s", e.Prefix, e.RetryAfter.Round(time.Second))
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+type QuotaError struct {
+	Prefix     *net.IPNet
+	MaxEntries int
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("too many addresses registered from %s, at most %d are allowed", e.Prefix, e.MaxEntries)
+}
+
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter enforces the rate limits and quotas of the config, it is shared by all frontends
+type RateLimiter struct {
+	config    *RateLimitConfig
+	buckets   map[string]*rateBucket
+	lock      sync.Mutex
+	lastClean time.Time
+}
+
+// ProvideRateLimiter returns the rate limiter of config, which checks the quotas whenever clients register addresses in store
+func ProvideRateLimiter(config *RateLimitConfig, store *Store) (*RateLimiter, error) {
+	for _, rule := range config.Rules {
+		if rule.Prefix4 < 0 || rule.Prefix4 > 32 || rule.Prefix6 < 0 || rule.Prefix6 > 128 {
+			return nil, ErrInvalidRatePrefix
+		}
+	}
+
+	r := &RateLimiter{
+		config:    config,
+		buckets:   make(map[string]*rateBucket),
+		lastClean: time.Now(),
+	}
+	if store != nil {
+		store.SetQuota(r.checkQuota)
+	}
+
+	return r, nil
+}
+
+// Prefix returns the network ip is grouped into by the rule
+func (r *RateLimitRule) Prefix(ip net.IP) *net.IPNet {
+	ip = normalizeIP(ip)
+
+	ones := r.Prefix6
+	if ones == 0 {
+		ones = 64
+	}
+	if len(ip) == net.IPv4len {
+		ones = r.Prefix4
+		if ones == 0 {
+			ones = 32
+		}
+	}
+
+	mask := net.CIDRMask(ones, len(ip)*8)
+	return &net.IPNet{
+		IP:   ip.Mask(mask),
+		Mask: mask,
+	}
+}
+
+func (r *RateLimitRule) interval() time.Duration {
+	if r.Interval == 0 {
+		return time.Minute
+	}
+
+	return r.Interval
+}
+
+// refill adds the tokens gained since the last request, up to the burst of Requests
+func (r *RateLimitRule) refill(b *rateBucket, now time.Time) {
+	b.tokens += float64(now.Sub(b.last)) / float64(r.interval()) * float64(r.Requests)
+	if b.tokens > float64(r.Requests) {
+		b.tokens = float64(r.Requests)
+	}
+	b.last = now
+}
+
+// Allow counts a request of ip against the rate limits, returning a *RateLimitError if it is over any of them
+func (r *RateLimiter) Allow(ip net.IP) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	r.clean(now)
+
+	var buckets []*rateBucket
+	for i := range r.config.Rules {
+		rule := &r.config.Rules[i]
+		if rule.Requests <= 0 {
+			continue
+		}
+
+		prefix := rule.Prefix(ip)
+		key := fmt.Sprintf("%d-%s", i, prefix)
+		b := r.buckets[key]
+		if b == nil {
+			b = &rateBucket{
+				tokens: float64(rule.Requests),
+				last:   now,
+			}
+			r.buckets[key] = b
+		}
+
+		rule.refill(b, now)
+		if b.tokens < 1 {
+			return &RateLimitError{
+				Prefix:     prefix,
+				RetryAfter: time.Duration((1 - b.tokens) / float64(rule.Requests) * float64(rule.interval())),
+			}
+		}
+
+		buckets = append(buckets, b)
+	}
+
+	// only count the request once it passed all rules
+	for _, b := range buckets {
+		b.tokens--
+	}
+
+	return nil
+}
+
+// clean drops the buckets that are full again, as they are the same as new ones
+func (r *RateLimiter) clean(now time.Time) {
+	if now.Sub(r.lastClean) < time.Minute {
+		return
+	}
+	r.lastClean = now
+
+	for key, b := range r.buckets {
+		full := true
+		for i := range r.config.Rules {
+			rule := &r.config.Rules[i]
+			if rule.Requests > 0 && now.Sub(b.last) < rule.interval() {
+				full = false
+			}
+		}
+
+		if full {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// checkQuota returns a *QuotaError if registering ip in tx would exceed the quota of its prefix, see Store.SetQuota
+func (r *RateLimiter) checkQuota(tx BackendTx, ip net.IP) error {
+	for i := range r.config.Rules {
+		rule := &r.config.Rules[i]
+		if rule.MaxEntries <= 0 {
+			continue
+		}
+
+		prefix := rule.Prefix(ip)
+		count := 0
+		err := tx.ForEachIP(prefix, func(ip net.IP, id string) error {
+			count++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if count >= rule.MaxEntries {
+			return &QuotaError{
+				Prefix:     prefix,
+				MaxEntries: rule.MaxEntries,
+			}
+		}
+	}
+
+	return nil
+}
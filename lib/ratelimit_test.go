@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQuota(t *testing.T) {
+	store := testStore(t, &StoreConfig{TTL: time.Hour})
+	_, err := ProvideRateLimiter(&RateLimitConfig{
+		Rules: []RateLimitRule{{Prefix4: 24, MaxEntries: 3}},
+	}, store)
+	assert.NoError(t, err)
+
+	// concurrent registrations can't exceed the quota together
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	added, exceeded := 0, 0
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _, err := store.AddEntry(Auth{IP: net.IPv4(192, 0, 2, byte(i))}, fmt.Sprintf("quota%d", i))
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err == nil {
+				added++
+			} else if errors.Is(err, ErrQuotaExceeded) {
+				exceeded++
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 3, added)
+	assert.Equal(t, 7, exceeded)
+
+	// registered addresses are still renewed, other networks aren't affected
+	var registered net.IP
+	assert.NoError(t, store.ForEach(func(name string, entry Entry) error {
+		registered = entry.Value4
+		return nil
+	}))
+	_, _, err = store.AddEntry(Auth{IP: registered}, "")
+	assert.NoError(t, err)
+	_, _, err = store.AddEntry(Auth{IP: net.IPv4(198, 51, 100, 1)}, "other")
+	assert.NoError(t, err)
+}
+
+func TestRateLimiterPrefixes(t *testing.T) {
+	for _, rule := range []RateLimitRule{{Prefix4: 33}, {Prefix4: -1}, {Prefix6: 129}} {
+		_, err := ProvideRateLimiter(&RateLimitConfig{Rules: []RateLimitRule{rule}}, nil)
+		assert.ErrorIs(t, err, ErrInvalidRatePrefix)
+	}
+
+	_, err := ProvideRateLimiter(&RateLimitConfig{Rules: []RateLimitRule{{Prefix4: 32, Prefix6: 128}}}, nil)
+	assert.NoError(t, err)
+}
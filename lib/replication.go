@@ -0,0 +1,544 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FrontendReplication is recorded in the history of replicas for the changes they followed
+const FrontendReplication = "replication"
+
+// replicationPing is how often the primary sends a message on idle streams, replicas reconnect after missing a few
+const replicationPing = 15 * time.Second
+const replicationTimeout = 3 * replicationPing
+
+// replicationBuffer is the number of changes a stream may lag behind, slower replicas are disconnected and resync
+const replicationBuffer = 1000
+
+// replicationWait is how long replicas wait for a change they forwarded to come back from the primary
+const replicationWait = 2 * time.Second
+
+var errReplicaBehind = errors.New("replica fell behind")
+
+// replicatedErrors are the errors of the store that are passed on to replicas as they are, or with details after them
+var replicatedErrors = []error{ErrNoEntry, ErrInvalidLink, ErrNotFound, ErrNotAllowed, ErrMaxLifetime, ErrAddressInUse, ErrInvalidName,
+	ErrInvalidTXT, ErrInvalidAllowFrom, ErrQuotaExceeded}
+
+// replicationMessage is a line of the change stream
+type replicationMessage struct {
+	// Op is "snapshot" for the first message holding all entries, "put", "delete" or "ping"
+	Op     string      `json:"op"`
+	Serial uint32      `json:"serial,omitempty"`
+	ID     string      `json:"id,omitempty"`
+	Reason EventReason `json:"reason,omitempty"`
+	Entry  *Entry      `json:"entry,omitempty"`
+	// Entries are the entries of a snapshot
+	Entries []ExportedEntry `json:"entries,omitempty"`
+}
+
+// replicationCall is a change a replica forwards to the primary
+type replicationCall struct {
+	Method   string   `json:"method"`
+	ID       string   `json:"id,omitempty"`
+	IP       net.IP   `json:"ip"`
+	Token    string   `json:"token,omitempty"`
+	Frontend string   `json:"frontend,omitempty"`
+	Key      string   `json:"key,omitempty"`
+	IPs      []net.IP `json:"ips,omitempty"`
+	// User, TXT and AllowFrom are the arguments of the acme-dns calls
+	User      string   `json:"user,omitempty"`
+	TXT       string   `json:"txt,omitempty"`
+	AllowFrom []string `json:"allow_from,omitempty"`
+}
+
+type replicationResult struct {
+	Entry Entry `json:"entry"`
+	// Token is the token of the entry, if one was issued
+	Token string `json:"token,omitempty"`
+	// Secret is the key of an acme-dns account, if one was registered
+	Secret string `json:"secret,omitempty"`
+	// Name is the DNS name of the entry, or the code for links
+	Name    string    `json:"name,omitempty"`
+	Expires time.Time `json:"expires,omitempty"`
+	Serial  uint32    `json:"serial"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func (r *replicationResult) entry() Entry {
+	entry := r.Entry
+	entry.Token = r.Token
+	return entry
+}
+
+func (r *replicationResult) err() error {
+	if r.Error == "" {
+		return nil
+	}
+
+	for _, err := range replicatedErrors {
+		if err.Error() == r.Error {
+			return err
+		}
+		if details, ok := strings.CutPrefix(r.Error, err.Error()); ok && strings.HasPrefix(details, " ") {
+			return fmt.Errorf("%w%s", err, details)
+		}
+	}
+
+	return errors.New("primary: " + r.Error)
+}
+
+// primaryClient connects replicas to their primary
+type primaryClient struct {
+	config *ReplicationConfig
+	client *http.Client
+}
+
+func newPrimaryClient(config *ReplicationConfig) *primaryClient {
+	return &primaryClient{
+		config: config,
+		client: &http.Client{},
+	}
+}
+
+func (p *primaryClient) request(ctx context.Context, method string, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(p.config.Primary, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.config.Token)
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("primary replied with %s", res.Status)
+	}
+
+	return res, nil
+}
+
+// forward makes the primary execute call, waiting for its change to be replicated.
+// The result is never nil.
+func (s *Store) forward(call *replicationCall) (*replicationResult, error) {
+	result := &replicationResult{}
+
+	body, err := json.Marshal(call)
+	if err != nil {
+		return result, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := s.primary.request(ctx, "POST", "/replication/call", body)
+	if err != nil {
+		return result, err
+	}
+	defer res.Body.Close()
+
+	err = json.NewDecoder(res.Body).Decode(result)
+	if err != nil {
+		return result, err
+	}
+
+	// so clients see their change when they look at this replica right after
+	deadline := time.Now().Add(replicationWait)
+	for SerialCompare(s.GetSerial(), result.Serial) < 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return result, result.err()
+}
+
+func forwardCall(method string, id string, auth Auth) *replicationCall {
+	return &replicationCall{
+		Method:   method,
+		ID:       id,
+		IP:       auth.IP,
+		Token:    auth.Token,
+		Frontend: auth.Frontend,
+		Key:      auth.Key,
+	}
+}
+
+// execute runs a call forwarded by a replica
+func (s *Store) execute(call *replicationCall) *replicationResult {
+	auth := Auth{IP: call.IP, Token: call.Token, Frontend: call.Frontend, Key: call.Key}
+	result := &replicationResult{}
+
+	var entry Entry
+	var err error
+	switch call.Method {
+	case "add":
+		entry, result.Name, err = s.AddEntry(auth, call.ID)
+	case "renew":
+		entry, result.Name, err = s.RenewEntry(call.ID, auth)
+	case "delete":
+		result.Name, err = s.DeleteEntry(call.ID, auth)
+	case "update":
+		entry, result.Name, err = s.UpdateEntry(call.ID, auth, call.IPs...)
+	case "update_renew":
+		entry, result.Name, err = s.UpdateRenewEntry(call.ID, auth, call.IPs...)
+	case "token":
+		entry, result.Name, err = s.ResetToken(call.ID, auth)
+	case "key":
+		entry, result.Name, err = s.IssueKey(call.ID, auth)
+	case "acme_register":
+		entry, result.Name, result.Secret, err = s.RegisterACME(call.ID, auth, call.AllowFrom)
+	case "acme_update":
+		err = s.UpdateTXT(call.ID, call.User, call.Token, auth, call.TXT)
+	case "create_link":
+		result.Name, result.Expires, err = s.CreateLink(call.IP)
+	case "link":
+		entry, result.Name, err = s.Link(call.ID, auth)
+	default:
+		err = errors.New("unknown method " + call.Method)
+	}
+
+	result.Entry = entry
+	result.Token = entry.Token
+	result.Serial = s.GetSerial()
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// stream sends a snapshot of all entries followed by their changes until ctx is done
+func (s *Store) stream(ctx context.Context, send func(msg *replicationMessage) error) error {
+	err := s.AssertDB()
+	if err != nil {
+		return err
+	}
+
+	// subscribe first, so no change is missed between the snapshot and the stream
+	events := make(chan Event, replicationBuffer)
+	behind := make(chan struct{})
+	var once sync.Once
+	unsubscribe := s.Subscribe(func(event Event) {
+		select {
+		case events <- event:
+		default:
+			once.Do(func() {
+				close(behind)
+			})
+		}
+	})
+	defer unsubscribe()
+
+	snapshot := &replicationMessage{Op: "snapshot"}
+	err = s.backend.View(func(tx BackendTx) error {
+		var err error
+		snapshot.Serial, err = tx.GetSerial()
+		if err != nil {
+			return err
+		}
+
+		return tx.ForEach(func(id string, entry *Entry) error {
+			snapshot.Entries = append(snapshot.Entries, ExportedEntry{ID: id, Entry: *entry})
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	err = send(snapshot)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(replicationPing)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-behind:
+			return errReplicaBehind
+		case <-ticker.C:
+			err = send(&replicationMessage{Op: "ping"})
+		case event := <-events:
+			if SerialCompare(event.Serial, snapshot.Serial) <= 0 { // part of the snapshot already
+				continue
+			}
+
+			msg := &replicationMessage{Op: "put", Serial: event.Serial, ID: event.ID, Reason: event.Reason}
+			if event.Type == EventRemoved {
+				msg.Op = "delete"
+			} else {
+				msg.Entry = &event.Entry
+			}
+			err = send(msg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sameEntry reports whether a replicated entry differs from the stored one
+func sameEntry(a *Entry, b *Entry) bool {
+	if !a.Created.Equal(b.Created) || !a.Expires.Equal(b.Expires) || a.TokenHash != b.TokenHash || a.TSIGSecret != b.TSIGSecret {
+		return false
+	}
+
+	acmeA, _ := json.Marshal(a.ACME)
+	acmeB, _ := json.Marshal(b.ACME)
+	if !bytes.Equal(acmeA, acmeB) {
+		return false
+	}
+
+	return normalizeIP(a.Value).Equal(normalizeIP(b.Value)) && normalizeIP(a.Value4).Equal(normalizeIP(b.Value4)) &&
+		a.Claimed == b.Claimed && a.Claimed4 == b.Claimed4
+}
+
+// putReplicated stores an entry of the primary, replacing the previous one
+func putReplicated(tx *storeTx, id string, entry Entry, reason EventReason) error {
+	existing, err := tx.GetEntry(id)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if sameEntry(existing, &entry) {
+			return nil
+		}
+
+		err := removeEntry(tx, id, existing)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, ip := range entry.HeldIPs() {
+		err := attachIP(tx, id, &entry, ip)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.PutEntry(id, &entry)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil {
+		tx.emit(EventChanged, reason, id, &entry)
+	} else {
+		tx.emit(EventAdded, reason, id, &entry)
+	}
+
+	return nil
+}
+
+// deleteReplicated removes an entry the primary removed
+func deleteReplicated(tx *storeTx, id string, reason EventReason) error {
+	existing, err := tx.GetEntry(id)
+	if err != nil || existing == nil {
+		return err
+	}
+
+	err = removeEntry(tx, id, existing)
+	if err != nil {
+		return err
+	}
+	tx.emit(EventRemoved, reason, id, existing)
+
+	return nil
+}
+
+// apply applies a message of the change stream of the primary
+func (s *Store) apply(msg *replicationMessage) error {
+	if msg.Op == "ping" {
+		return nil
+	}
+
+	return s.change(Auth{Frontend: FrontendReplication}, func(tx *storeTx) error {
+		tx.serial = msg.Serial
+
+		switch msg.Op {
+		case "snapshot":
+			ids := make(map[string]bool)
+			for _, e := range msg.Entries {
+				ids[e.ID] = true
+				err := putReplicated(tx, e.ID, e.Entry, ReasonImported)
+				if err != nil {
+					return err
+				}
+			}
+
+			// whatever is left was removed while this replica was away
+			var removed []string
+			err := tx.ForEach(func(id string, entry *Entry) error {
+				if !ids[id] {
+					removed = append(removed, id)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, id := range removed {
+				err := deleteReplicated(tx, id, ReasonReleased)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		case "put":
+			if msg.Entry == nil {
+				return errors.New("replicated entry missing")
+			}
+
+			return putReplicated(tx, msg.ID, *msg.Entry, msg.Reason)
+		case "delete":
+			return deleteReplicated(tx, msg.ID, msg.Reason)
+		}
+
+		return errors.New("unknown replication op " + msg.Op)
+	})
+}
+
+// followOnce applies the change stream of the primary until it breaks, reporting whether it got any message
+func (s *Store) followOnce(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the primary pings idle streams, so a stream without messages is dead
+	timeout := time.AfterFunc(replicationTimeout, cancel)
+	defer timeout.Stop()
+
+	res, err := s.primary.request(ctx, "GET", "/replication/stream", nil)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	received := false
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		timeout.Reset(replicationTimeout)
+
+		msg := &replicationMessage{}
+		err := json.Unmarshal(scanner.Bytes(), msg)
+		if err != nil {
+			return received, err
+		}
+
+		err = s.apply(msg)
+		if err != nil {
+			return received, err
+		}
+
+		if msg.Op == "snapshot" {
+			log.Printf("Replicated %d entries from %s at serial %d\n", len(msg.Entries), s.Config.Replication.Primary, msg.Serial)
+		}
+		received = true
+	}
+	if err := scanner.Err(); err != nil {
+		return received, err
+	}
+
+	return received, errors.New("primary closed the stream")
+}
+
+// follow keeps the store in sync with the primary until ctx is done
+func (s *Store) follow(ctx context.Context) {
+	delay := time.Second
+
+	for {
+		received, err := s.followOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if received {
+			delay = time.Second
+		}
+
+		sentry.CaptureException(err)
+		log.Printf("Replication from %s interrupted, retrying in %s: %s\n", s.Config.Replication.Primary, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay < 30*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// replicaRequest reports whether request is one of a replica to its endpoints, authenticated by the replication token.
+// Replicas limited their clients already, so these aren't limited again.
+func replicaRequest(store *Store, request *http.Request) bool {
+	if store.primary != nil || (request.URL.Path != "/replication/stream" && request.URL.Path != "/replication/call") {
+		return false
+	}
+
+	return hasBearer(store.Config.Replication.Token, request)
+}
+
+// handleReplication adds the endpoints replicas use to mux, on primaries with a replication token
+func handleReplication(mux *http.ServeMux, store *Store) {
+	token := store.Config.Replication.Token
+	if token == "" || store.primary != nil {
+		return
+	}
+
+	mux.HandleFunc("/replication/stream", bearerOnly(token, func(writer http.ResponseWriter, request *http.Request) {
+		flusher, ok := writer.(http.Flusher)
+		if request.Method != "GET" || !ok {
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(writer)
+		err := store.stream(request.Context(), func(msg *replicationMessage) error {
+			err := encoder.Encode(msg)
+			flusher.Flush()
+			return err
+		})
+		if err != nil {
+			log.Printf("Replication to %s ended: %s\n", request.RemoteAddr, err)
+		}
+	}))
+
+	mux.HandleFunc("/replication/call", bearerOnly(token, func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != "POST" {
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		call := &replicationCall{}
+		err := json.NewDecoder(request.Body).Decode(call)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		err = json.NewEncoder(writer).Encode(store.execute(call))
+		if err != nil {
+			sentry.CaptureException(err)
+		}
+	}))
+}
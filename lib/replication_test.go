@@ -0,0 +1,124 @@
+package lib
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReplication(t *testing.T) {
+	primary := testStore(t, &StoreConfig{
+		TTL:           time.Hour,
+		SweepInterval: 50 * time.Millisecond,
+		Replication:   ReplicationConfig{Token: "secret"},
+	})
+
+	ip := net.ParseIP("2001:db8::1")
+	_, before, err := primary.AddEntry(Auth{IP: ip}, "")
+	assert.NoError(t, err)
+
+	mux := http.NewServeMux()
+	handleReplication(mux, primary)
+	server := httptest.NewServer(mux)
+	// after the replica is closed, as the server waits for its stream to end
+	t.Cleanup(server.Close)
+
+	replica := testStore(t, &StoreConfig{
+		TTL:         time.Hour,
+		Replication: ReplicationConfig{Primary: server.URL, Token: "secret"},
+	})
+
+	// only the primary sends webhooks
+	events := make(chan string, 10)
+	hook := func(name string) []WebhookConfig {
+		receiver := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			events <- name + " " + request.Header.Get("X-Event")
+		}))
+		t.Cleanup(receiver.Close)
+
+		return []WebhookConfig{{URL: receiver.URL}}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ProvideWebhooks(hook("primary"), primary, ctx, nil)
+	ProvideWebhooks(hook("replica"), replica, ctx, nil)
+
+	// the snapshot brings over the existing entries
+	assert.Eventually(t, func() bool {
+		_, name, err := replica.ResolveIP(ip)
+		return err == nil && name == before
+	}, time.Second, 10*time.Millisecond)
+
+	// changes are forwarded to the primary and visible on the replica right after
+	ip2 := net.ParseIP("2001:db8::2")
+	entry, name, err := replica.AddEntry(Auth{IP: ip2}, "replicated")
+	assert.NoError(t, err)
+	assert.Equal(t, "replicated.give-me-dns.net", name)
+	assert.NotEmpty(t, entry.Token)
+
+	resolved, err := primary.ResolveEntry("replicated")
+	assert.NoError(t, err)
+	assert.NotNil(t, resolved)
+	resolved, err = replica.ResolveEntry("replicated")
+	assert.NoError(t, err)
+	assert.NotNil(t, resolved)
+	assert.Equal(t, primary.GetSerial(), replica.GetSerial())
+
+	_, err = replica.DeleteEntry("replicated", Auth{IP: ip})
+	assert.ErrorIs(t, err, ErrNotAllowed)
+
+	// new tokens reach the replica, which doesn't accept the old one anymore
+	reset, _, err := replica.ResetToken("replicated", Auth{IP: ip2})
+	assert.NoError(t, err)
+	replicated, err := replica.ResolveEntry("replicated")
+	assert.NoError(t, err)
+	assert.Equal(t, hashToken(reset.Token), replicated.TokenHash)
+	entry = reset
+
+	_, err = replica.DeleteEntry("replicated", Auth{IP: net.ParseIP("2001:db8::3"), Token: entry.Token})
+	assert.NoError(t, err)
+	resolved, err = replica.ResolveEntry("replicated")
+	assert.NoError(t, err)
+	assert.Nil(t, resolved)
+
+	for _, event := range []string{"primary " + WebhookRegistered, "primary " + WebhookReleased} {
+		select {
+		case received := <-events:
+			assert.Equal(t, event, received)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no %s webhook received", event)
+		}
+	}
+
+	// replicas need the token
+	_, err = replica.Import(nil)
+	assert.ErrorIs(t, err, ErrReplica)
+	res, err := http.Get(server.URL + "/replication/stream")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	res.Body.Close()
+}
+
+func TestReplicaRequest(t *testing.T) {
+	store := testStore(t, &StoreConfig{
+		TTL:         time.Hour,
+		Replication: ReplicationConfig{Token: "secret"},
+	})
+
+	request := func(path string, token string) *http.Request {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req
+	}
+
+	// only the endpoints of the replicas with their token skip the rate limits
+	assert.True(t, replicaRequest(store, request("/replication/call", "secret")))
+	assert.True(t, replicaRequest(store, request("/replication/stream", "secret")))
+	assert.False(t, replicaRequest(store, request("/replication/call", "wrong")))
+	assert.False(t, replicaRequest(store, request("/replication/x", "secret")))
+	assert.False(t, replicaRequest(store, request("/", "secret")))
+}
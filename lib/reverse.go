@@ -0,0 +1,177 @@
+package lib
+
+import (
+	"errors"
+	"github.com/getsentry/sentry-go"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidReverseZone = errors.New("reverse zones have to be below ip6.arpa or in-addr.arpa")
+
+// reverseLabels returns the number of labels of the full reverse name of an address in zone, or 0 if zone isn't a reverse zone
+func reverseLabels(zone string) int {
+	switch {
+	case dns.IsSubDomain("ip6.arpa.", zone):
+		return 32 + 2
+	case dns.IsSubDomain("in-addr.arpa.", zone):
+		return 4 + 2
+	}
+
+	return 0
+}
+
+// ParseReverse decodes the address of a reverse name, like 1.0.0.0.[...].8.b.d.0.1.0.0.2.ip6.arpa or 1.2.0.192.in-addr.arpa,
+// or returns nil if name isn't the full reverse name of an address
+func ParseReverse(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	if labels, ok := strings.CutSuffix(name, ".ip6.arpa."); ok {
+		nibbles := strings.Split(labels, ".")
+		if len(nibbles) != 32 {
+			return nil
+		}
+
+		ip := make(net.IP, net.IPv6len)
+		for i, nibble := range nibbles { // least significant first
+			v, err := strconv.ParseUint(nibble, 16, 4)
+			if err != nil || len(nibble) != 1 {
+				return nil
+			}
+
+			pos := 31 - i
+			ip[pos/2] |= byte(v) << (4 * (1 - pos%2))
+		}
+
+		return ip
+	}
+
+	if labels, ok := strings.CutSuffix(name, ".in-addr.arpa."); ok {
+		octets := strings.Split(labels, ".")
+		if len(octets) != 4 {
+			return nil
+		}
+
+		for i, j := 0, len(octets)-1; i < j; i, j = i+1, j-1 {
+			octets[i], octets[j] = octets[j], octets[i]
+		}
+
+		return net.ParseIP(strings.Join(octets, ".")).To4()
+	}
+
+	return nil
+}
+
+// ptrRR returns the PTR record of the entry named dnsName at name
+func ptrRR(name string, dnsName string, store *Store) dns.RR {
+	return &dns.PTR{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypePTR,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(store.Config.TTL.Seconds()),
+		},
+		Ptr: dns.Fqdn(dnsName),
+	}
+}
+
+// parseReverseQuery answers queries of the reverse zone of s with the names of the registered addresses
+func parseReverseQuery(r *dns.Msg, m *dns.Msg, store *Store, config *DNSConfig, s *DNSSECSigner) {
+	m.Authoritative = true
+
+	zone := s.origin()
+	shouldSign := replyEdns0(r, m)
+
+	for _, q := range m.Question {
+		isapex := strings.ToLower(q.Name) == zone
+		dnsName := ""
+
+		var answer []dns.RR
+
+		log.Printf("Question %s", q.String())
+
+		switch q.Qtype {
+		case dns.TypeDNSKEY:
+			if isapex {
+				answer = append(answer, s.GetDNSKEYs()...)
+			}
+		case dns.TypeNS:
+			if isapex {
+				answer = append(answer, nsRRs(config, zone)...)
+			}
+		case dns.TypeSOA:
+			if isapex {
+				answer = append(answer, s.GetSOA())
+			}
+		}
+
+		if ip := ParseReverse(q.Name); ip != nil {
+			var err error
+			_, dnsName, err = store.ResolveIP(ip)
+			if err != nil {
+				sentry.CaptureException(err)
+				log.Printf("Failed to resolve: %s", err)
+			}
+
+			if dnsName != "" && q.Qtype == dns.TypePTR {
+				log.Printf("Query for %s - Resolved %s\n", q.Name, dnsName)
+				answer = append(answer, ptrRR(q.Name, dnsName, store))
+			}
+		}
+
+		// shorter names lead to the addresses, so they exist as well
+		err := finishAnswer(m, q, answer, s, shouldSign, func() ([]uint16, bool) {
+			switch {
+			case isapex:
+				return []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeDNSKEY}, true
+			case dnsName != "":
+				return []uint16{dns.TypePTR}, true
+			}
+			return nil, dns.CountLabel(q.Name) < reverseLabels(zone)
+		})
+		if err != nil {
+			servFail(m, err)
+			return
+		}
+	}
+}
+
+// provideReverse adds the handlers of the reverse zones of config to mux
+func provideReverse(mux *dns.ServeMux, config *DNSConfig, store *Store) error {
+	for _, reverse := range config.Reverse {
+		zone := dns.Fqdn(strings.ToLower(reverse.Zone))
+		if reverseLabels(zone) == 0 {
+			return ErrInvalidReverseZone
+		}
+
+		s := &DNSSECSigner{
+			config: config,
+			store:  store,
+			zone:   zone,
+		}
+		err := s.setup(reverse.DNSSECKey, reverse.DNSSECZSK, "dnssec_key (of the reverse zone "+reverse.Zone+")")
+		if err != nil {
+			return err
+		}
+
+		mux.HandleFunc(zone, func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Compress = false
+
+			if r.Opcode == dns.OpcodeQuery {
+				parseReverseQuery(r, m, store, config, s)
+			}
+
+			err := w.WriteMsg(m)
+			if err != nil {
+				log.Printf("RESPONSE WRITING ERROR: %s", err)
+			}
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,27 @@
+package lib
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestParseReverse(t *testing.T) {
+	assert.Equal(t, net.ParseIP("192.0.2.1").To4(), ParseReverse("1.2.0.192.in-addr.arpa."))
+	assert.Equal(t, net.ParseIP("2001:db8::1"), ParseReverse("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"))
+	assert.Equal(t, net.ParseIP("2001:db8::abcd"), ParseReverse("D.C.B.A.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.IP6.ARPA."))
+
+	for _, name := range []string{
+		"2.0.192.in-addr.arpa.",
+		"256.2.0.192.in-addr.arpa.",
+		"0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+		"10.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+		"1.2.0.192.give-me-dns.net.",
+	} {
+		assert.Nil(t, ParseReverse(name), name)
+	}
+
+	assert.Equal(t, 6, reverseLabels("2.0.192.in-addr.arpa."))
+	assert.Equal(t, 34, reverseLabels("8.b.d.0.1.0.0.2.ip6.arpa."))
+	assert.Equal(t, 0, reverseLabels("give-me-dns.net."))
+}
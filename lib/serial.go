@@ -0,0 +1,22 @@
+package lib
+
+// SerialAdd adds n to serial as defined by RFC 1982, n must not be larger than 2^31-1
+func SerialAdd(serial uint32, n uint32) uint32 {
+	return serial + n
+}
+
+// SerialCompare compares the serials a and b as defined by RFC 1982, returning -1 if a is less than b,
+// 0 if they are equal and 1 if a is greater than b.
+// The comparison of serials exactly 2^31 apart is undefined, -1 is returned for them so that a is treated as outdated.
+func SerialCompare(a uint32, b uint32) int {
+	switch {
+	case a == b:
+		return 0
+	case a-b == 1<<31:
+		return -1
+	case (a < b && b-a < 1<<31) || (a > b && a-b > 1<<31):
+		return -1
+	}
+
+	return 1
+}
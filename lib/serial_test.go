@@ -0,0 +1,18 @@
+package lib
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSerialCompare(t *testing.T) {
+	assert.Equal(t, 0, SerialCompare(1, 1))
+	assert.Equal(t, -1, SerialCompare(1, 2))
+	assert.Equal(t, 1, SerialCompare(2, 1))
+
+	// serials wrap around
+	assert.Equal(t, uint32(1), SerialAdd(0xffffffff, 2))
+	assert.Equal(t, 1, SerialCompare(1, 0xffffffff))
+	assert.Equal(t, -1, SerialCompare(0xffffffff, 1))
+	assert.Equal(t, -1, SerialCompare(0, 1<<31))
+}
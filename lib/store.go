@@ -2,38 +2,254 @@ package lib
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
 	"errors"
 	"github.com/getsentry/sentry-go"
 	"github.com/mkg20001/give-me-dns/lib/idprov"
-	bolt "go.etcd.io/bbolt"
+	"io"
+	"log"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var ErrNoEntry = errors.New("no entry registered for this address")
+var ErrInvalidLink = errors.New("invalid or expired link code")
+var ErrNotFound = errors.New("no such entry")
+var ErrNotAllowed = errors.New("not allowed to manage this entry")
+var ErrMaxLifetime = errors.New("entry reached its maximum lifetime")
+var ErrAddressInUse = errors.New("address is in use by another entry")
+var ErrReplica = errors.New("store is a replica, change its primary instead")
+
+const DefaultLinkTTL = 10 * time.Minute
+const DefaultSweepInterval = 1 * time.Minute
+
 type Entry struct {
+	Created time.Time `json:"created,omitempty"`
 	Expires time.Time `json:"expires"`
-	Value   net.IP    `json:"value"`
+	// Value is the IPv6 address of the entry
+	Value net.IP `json:"value,omitempty"`
+	// Value4 is the IPv4 address of the entry
+	Value4 net.IP `json:"value4,omitempty"`
+	// Claimed and Claimed4 mark Value and Value4 as set by a client that didn't send from them, like with dyndns or
+	// DNS UPDATE. Claimed addresses are served, but kept out of the reverse index, so they don't count for registering,
+	// authenticating by address, PTR records and quotas.
+	Claimed  bool `json:"claimed,omitempty"`
+	Claimed4 bool `json:"claimed4,omitempty"`
+	// TokenHash is the hex encoded SHA-256 of the management token
+	TokenHash string `json:"token_hash,omitempty"`
+	// Token is the plain management token, only set right after it was issued
+	Token string `json:"-"`
+	// TSIGSecret is the base64 encoded secret of the TSIG key for DNS UPDATEs of the entry, see IssueKey
+	TSIGSecret string `json:"tsig_secret,omitempty"`
+	// ACME is the acme-dns account of the entry, see RegisterACME
+	ACME *ACMEAccount `json:"acme,omitempty"`
+}
+
+// Auth holds the credentials a client presents to manage an entry
+type Auth struct {
+	// IP is the address of the client, which may manage the entry holding it
+	IP net.IP
+	// Token is the management token, which may manage its entry from any address
+	Token string
+	// Frontend is the frontend the client uses, recorded in the history
+	Frontend string
+	// Key is the id of the entry whose TSIG key the frontend verified, which may manage only that entry
+	Key string
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (e *Entry) issueToken() error {
+	token, err := randomToken(20)
+	if err != nil {
+		return err
+	}
+
+	e.Token = token
+	e.TokenHash = hashToken(token)
+
+	return nil
+}
+
+func (e *Entry) CheckToken(token string) bool {
+	if e.TokenHash == "" || token == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(e.TokenHash), []byte(hashToken(token))) == 1
+}
+
+// normalizeIP returns the 4-byte form for IPv4 (including IPv4-mapped) addresses and the 16-byte form otherwise
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+
+	return ip.To16()
+}
+
+// SetIP sets the address of the family of ip, which the client holds
+func (e *Entry) SetIP(ip net.IP) {
+	ip = normalizeIP(ip)
+	if len(ip) == net.IPv4len {
+		e.Value4 = ip
+		e.Claimed4 = false
+	} else {
+		e.Value = ip
+		e.Claimed = false
+	}
+}
+
+// ClaimIP sets the address of the family of ip, which the client didn't prove to hold
+func (e *Entry) ClaimIP(ip net.IP) {
+	e.SetIP(ip)
+	if len(normalizeIP(ip)) == net.IPv4len {
+		e.Claimed4 = true
+	} else {
+		e.Claimed = true
+	}
+}
+
+// HasIP reports whether ip is one of the served addresses of the entry
+func (e *Entry) HasIP(ip net.IP) bool {
+	ip = normalizeIP(ip)
+	return ip != nil && (e.Value.Equal(ip) || e.Value4.Equal(ip))
+}
+
+// HoldsIP reports whether ip is one of the addresses of the entry that aren't claimed
+func (e *Entry) HoldsIP(ip net.IP) bool {
+	for _, held := range e.HeldIPs() {
+		if held.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (e *Entry) Expired(now time.Time) bool {
+	return e.Expires.Before(now)
+}
+
+// IPs returns the normalized addresses of the entry, as used for the keys of the reverse index
+func (e *Entry) IPs() []net.IP {
+	var ips []net.IP
+	if e.Value != nil {
+		ips = append(ips, normalizeIP(e.Value))
+	}
+	if e.Value4 != nil {
+		ips = append(ips, normalizeIP(e.Value4))
+	}
+
+	return ips
+}
+
+// HeldIPs returns the normalized addresses of the entry that aren't claimed, the keys of the reverse index
+func (e *Entry) HeldIPs() []net.IP {
+	var ips []net.IP
+	if e.Value != nil && !e.Claimed {
+		ips = append(ips, normalizeIP(e.Value))
+	}
+	if e.Value4 != nil && !e.Claimed4 {
+		ips = append(ips, normalizeIP(e.Value4))
+	}
+
+	return ips
 }
 
 type Store struct {
-	db         *bolt.DB
-	file       string
-	serial     int64
+	backend    Backend
+	open       bool
+	serial     uint32
 	openLock   sync.Mutex
 	openCancel context.CancelFunc
 	Config     *StoreConfig
 	providers  []idprov.IDProv
+	links      map[string]link
+	linksLock  sync.Mutex
+	// changeLock orders the changes, so their events are published in order
+	changeLock        sync.Mutex
+	subscriptions     []*subscription
+	subscriptionsLock sync.Mutex
+	// primary is set on replicas, which forward all changes to it
+	primary *primaryClient
+	// quota is checked for every address registered by a client, see SetQuota
+	quota QuotaFunc
+}
+
+// QuotaFunc returns an error if registering ip would exceed a quota. It runs in the transaction registering ip,
+// so concurrent registrations can't exceed it together.
+type QuotaFunc func(tx BackendTx, ip net.IP) error
+
+// SetQuota sets the quota checked for the addresses clients register, which aren't registered already.
+// Replicas leave it to their primary.
+func (s *Store) SetQuota(quota QuotaFunc) {
+	s.quota = quota
+}
+
+// checkQuota checks the quota of the store for ip, if it isn't registered already
+func (tx *storeTx) checkQuota(ip net.IP) error {
+	if tx.store.quota == nil {
+		return nil
+	}
+
+	owner, err := tx.GetID(ip)
+	if err != nil || owner != "" {
+		return err
+	}
+
+	return tx.store.quota(tx, ip)
+}
+
+type link struct {
+	id      string
+	expires time.Time
 }
 
 func ProvideStore(config *StoreConfig, providers []idprov.IDProv) (error, func() error, *Store) {
-	store := &Store{
-		Config:    config,
-		file:      config.File,
-		providers: providers,
+	backend, err := ProvideBackend(config)
+	if err != nil {
+		return err, nil, nil
+	}
+
+	store := NewStore(config, backend, providers)
+
+	// the sweeper works in the background, so log what it removed
+	store.Subscribe(func(event Event) {
+		if event.Reason == ReasonExpired {
+			log.Printf("Expired entry %s\n", event.Name)
+		}
+	})
+
+	err = store.Open()
+	if err != nil {
+		return err, nil, nil
+	}
+
+	return nil, func() error {
+		return store.Close()
+	}, store
+}
+
+// ProvideReadOnlyStore opens the store of config for reading only, see OpenReadOnly
+func ProvideReadOnlyStore(config *StoreConfig) (error, func() error, *Store) {
+	backend, err := ProvideReadOnlyBackend(config)
+	if err != nil {
+		return err, nil, nil
 	}
-	err := store.Open()
+
+	store := NewStore(config, backend, nil)
+	err = store.OpenReadOnly()
 	if err != nil {
 		return err, nil, nil
 	}
@@ -43,6 +259,21 @@ func ProvideStore(config *StoreConfig, providers []idprov.IDProv) (error, func()
 	}, store
 }
 
+func NewStore(config *StoreConfig, backend Backend, providers []idprov.IDProv) *Store {
+	store := &Store{
+		Config:    config,
+		backend:   backend,
+		providers: providers,
+		links:     make(map[string]link),
+	}
+
+	if config.Replication.Primary != "" {
+		store.primary = newPrimaryClient(&config.Replication)
+	}
+
+	return store
+}
+
 func (s *Store) Domain() string {
 	return s.Config.Domain
 }
@@ -51,268 +282,1121 @@ func (s *Store) TTL() time.Duration {
 	return s.Config.TTL
 }
 
+func (s *Store) LinkTTL() time.Duration {
+	if s.Config.LinkTTL == 0 {
+		return DefaultLinkTTL
+	}
+
+	return s.Config.LinkTTL
+}
+
+// MaxExpires returns the time after which the entry can't be renewed anymore, or zero time if there is no limit
+func (s *Store) MaxExpires(entry Entry) time.Time {
+	if s.Config.MaxLifetime == 0 {
+		return time.Time{}
+	}
+
+	created := entry.Created
+	if created.IsZero() { // entries from before lifetimes were tracked
+		created = entry.Expires.Add(-s.Config.TTL)
+	}
+
+	return created.Add(s.Config.MaxLifetime)
+}
+
+// renewedExpiry returns the new expiry of an entry renewed now, capped by the maximum lifetime
+func (s *Store) renewedExpiry(entry Entry) time.Time {
+	expires := time.Now().Add(s.Config.TTL)
+	maxExpires := s.MaxExpires(entry)
+	if !maxExpires.IsZero() && maxExpires.Before(expires) {
+		expires = maxExpires
+	}
+
+	if expires.Before(entry.Expires) {
+		return entry.Expires
+	}
+
+	return expires
+}
+
+// ParseID strips the domain from a DNS name, returning the bare id
+func (s *Store) ParseID(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	return strings.TrimSuffix(name, "."+s.Config.Domain)
+}
+
+func (s *Store) SweepInterval() time.Duration {
+	if s.Config.SweepInterval == 0 {
+		return DefaultSweepInterval
+	}
+
+	return s.Config.SweepInterval
+}
+
 func (s *Store) AssertDB() error {
-	if s.db == nil {
-		return bolt.ErrDatabaseNotOpen
+	if !s.open {
+		return ErrNotOpen
 	}
 
 	return nil
 }
 
-func (s *Store) Open() error {
-	if s.db != nil { // Idempotent
-		return nil
+// removeEntry deletes the entry id together with its addresses
+func removeEntry(tx BackendTx, id string, entry *Entry) error {
+	for _, ip := range entry.HeldIPs() {
+		owner, err := tx.GetID(ip)
+		if err != nil {
+			return err
+		}
+
+		if owner == id {
+			err := tx.DeleteID(ip)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	s.openLock.Lock()
-	defer s.openLock.Unlock()
+	return tx.DeleteEntry(id)
+}
+
+// getLiveEntry returns the entry id, or nil if it doesn't exist or expired
+func getLiveEntry(tx BackendTx, id string) (*Entry, error) {
+	entry, err := tx.GetEntry(id)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	if entry.Expired(time.Now()) {
+		return nil, nil
+	}
+
+	return entry, nil
+}
+
+// liveEntry is getLiveEntry, but expired entries that weren't swept yet are removed, so their id and addresses are free again
+func (tx *storeTx) liveEntry(id string) (*Entry, error) {
+	entry, err := tx.GetEntry(id)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	if entry.Expired(time.Now()) {
+		err := removeEntry(tx, id, entry)
+		if err != nil {
+			return nil, err
+		}
+		tx.emit(EventRemoved, ReasonExpired, id, entry)
+
+		return nil, nil
+	}
+
+	return entry, nil
+}
 
-	db, err := bolt.Open(s.file, 0600, nil)
+// expire removes all entries that expired before now
+func expire(tx *storeTx, now time.Time) error {
+	expired := make(map[string]*Entry)
+	err := tx.ForEachExpired(now, func(id string, entry *Entry) error {
+		expired[id] = entry
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	s.db = db
 
-	err = s.db.Update(func(tx *bolt.Tx) error {
-		// key: dns entry id - value: ip
-		bDNS, err := tx.CreateBucketIfNotExists([]byte("dns"))
+	for id, entry := range expired {
+		err := removeEntry(tx, id, entry)
 		if err != nil {
 			return err
 		}
+		tx.emit(EventRemoved, ReasonExpired, id, entry)
+	}
 
-		// key: ip - value: dns entry id
-		bIP, err := tx.CreateBucketIfNotExists([]byte("dns4ip"))
-		if err != nil {
+	return nil
+}
+
+func nextSerial(serial uint32) uint32 {
+	serial = SerialAdd(serial, 1)
+	if serial == 0 { // 0 means unset
+		serial = 1
+	}
+
+	return serial
+}
+
+// change runs fn in a write transaction for the client auth. If fn emitted events the serial is incremented
+// and the events are recorded in the history along with it, and they are published once the transaction is committed.
+func (s *Store) change(auth Auth, fn func(tx *storeTx) error) error {
+	s.changeLock.Lock()
+	defer s.changeLock.Unlock()
+
+	var events []Event
+	var serial uint32
+	err := s.backend.Update(func(backendTx BackendTx) error {
+		tx := &storeTx{BackendTx: backendTx, store: s, auth: auth}
+		err := fn(tx)
+		if err != nil || (len(tx.events) == 0 && tx.serial == 0) {
 			return err
 		}
 
-		var entryParsed Entry
-		now := time.Now()
-
-		c := bDNS.Cursor()
-		for id, entry := c.First(); id != nil; id, entry = c.Next() {
-			err := json.Unmarshal(entry, &entryParsed)
+		serial = tx.serial
+		if serial == 0 {
+			serial, err = tx.GetSerial()
 			if err != nil {
 				return err
 			}
 
-			if entryParsed.Expires.Before(now) {
-				err := bIP.Delete(entryParsed.Value)
-				if err != nil {
-					return err
-				}
+			serial = nextSerial(serial)
+		}
+		for i := range tx.events {
+			tx.events[i].Serial = serial
+		}
+		events = tx.events
 
-				err = bDNS.Delete(id)
-				if err != nil {
-					return err
-				}
-			} else {
-				if s.serial < entryParsed.Expires.Unix() {
-					s.serial = entryParsed.Expires.Unix()
-				}
-			}
+		err = s.record(tx, events)
+		if err != nil {
+			return err
 		}
 
-		return nil
+		return tx.PutSerial(serial)
 	})
 	if err != nil {
 		return err
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	s.openCancel = cancel
+	if serial != 0 {
+		atomic.StoreUint32(&s.serial, serial)
+		s.publish(events)
+	}
+
+	return nil
+}
+
+// sweep removes the expired entries every SweepInterval until ctx is done
+func (s *Store) sweep(ctx context.Context) {
+	ticker := time.NewTicker(s.SweepInterval())
+	defer ticker.Stop()
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-time.After(60 * 3600 * time.Second):
-				err := s.db.Update(func(tx *bolt.Tx) error {
-					bDNS := tx.Bucket([]byte("dns"))
-					bIP := tx.Bucket([]byte("dns4ip"))
-
-					now := time.Now()
-
-					c := bDNS.Cursor()
-					var entryParsed Entry
-					for id, entry := c.First(); id != nil; id, entry = c.Next() {
-						err := json.Unmarshal(entry, &entryParsed)
-						if err != nil {
-							return err
-						}
-
-						if entryParsed.Expires.Before(now) {
-							err := bIP.Delete(entryParsed.Value)
-							if err != nil {
-								return err
-							}
-
-							err = bDNS.Delete(id)
-							if err != nil {
-								return err
-							}
-						}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.change(Auth{}, func(tx *storeTx) error {
+				now := time.Now()
+				if retention := s.HistoryRetention(); retention != 0 {
+					err := tx.DeleteHistory(now.Add(-retention))
+					if err != nil {
+						return err
 					}
+				}
 
+				// replicas leave expiring to the primary, which they follow instead
+				if s.primary != nil {
 					return nil
-				})
-
-				if err != nil {
-					sentry.CaptureException(err)
-					return
 				}
+
+				return expire(tx, now)
+			})
+
+			// keep going, the next sweep picks up what this one missed
+			if err != nil && !errors.Is(err, ErrNotOpen) {
+				sentry.CaptureException(err)
+				log.Printf("Failed to sweep expired entries: %s", err)
 			}
 		}
-	}()
-
-	return nil
+	}
 }
 
-func (s *Store) Close() error {
-	if s.db == nil {
+func (s *Store) Open() error {
+	if s.open { // Idempotent
 		return nil
 	}
 
 	s.openLock.Lock()
 	defer s.openLock.Unlock()
 
-	s.openCancel()
-	s.openCancel = nil
-
-	err := s.db.Close()
+	err := s.backend.Open()
 	if err != nil {
 		return err
 	}
 
-	s.db = nil
-
-	return nil
-}
-
-func (s *Store) AddEntry(ipaddr net.IP) (Entry, string, error) {
-	var entry Entry
-	var id string
-
-	err := s.AssertDB()
-	if err != nil {
-		return entry, id, err
-	}
-
-	err = s.db.Update(func(tx *bolt.Tx) error {
-		bDNS := tx.Bucket([]byte("dns"))
-		bIP := tx.Bucket([]byte("dns4ip"))
+	var serial uint32
+	err = s.backend.Update(func(tx BackendTx) error {
+		var err error
+		serial, err = tx.GetSerial()
+		if err != nil {
+			return err
+		}
 
-		idByte := bIP.Get(ipaddr)
-		provId := -1
-		maxTries := 50
-		if idByte == nil {
-		genID:
-			provId = (provId + 1) % len(s.providers)
-			maxTries = maxTries - 1
-			if maxTries == 0 {
-				return errors.New("could not find any free id")
-			}
-			id, err := s.providers[provId].GetID()
-			if err != nil {
-				return err
-			}
-			idByte = []byte(id)
-			existingEntry := bDNS.Get(idByte)
-			if existingEntry != nil {
-				goto genID
-			}
+		if serial == 0 {
+			// the serial used to be the latest expiry, so continue from there to not go backwards
+			serial = uint32(time.Now().Unix())
+			err := tx.ForEach(func(id string, entry *Entry) error {
+				if serial < uint32(entry.Expires.Unix()) {
+					serial = uint32(entry.Expires.Unix())
+				}
 
-			err = bIP.Put(ipaddr, idByte)
+				return nil
+			})
 			if err != nil {
 				return err
 			}
-		}
 
-		entry = Entry{
-			Expires: time.Now().Add(s.Config.TTL),
-			Value:   ipaddr,
-		}
-		s.serial = entry.Expires.Unix()
-		marshal, err := json.Marshal(entry)
-		if err != nil {
-			return err
-		}
-		err = bDNS.Put(idByte, marshal)
-		if err != nil {
-			return err
+			return tx.PutSerial(serial)
 		}
 
-		id = string(idByte) + "." + s.Config.Domain
-
 		return nil
 	})
-
-	return entry, id, err
-}
-
-func (s *Store) ResolveEntry(id string) (net.IP, error) {
-	err := s.AssertDB()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var ip net.IP
+	atomic.StoreUint32(&s.serial, serial)
 
-	err = s.db.View(func(tx *bolt.Tx) error {
-		bDNS := tx.Bucket([]byte("dns"))
-		entry := bDNS.Get([]byte(id))
-		if entry == nil {
-			return nil
-		}
-		var entryParsed Entry
-		err := json.Unmarshal(entry, &entryParsed)
+	if s.primary == nil {
+		err = s.change(Auth{}, func(tx *storeTx) error {
+			return expire(tx, time.Now())
+		})
 		if err != nil {
 			return err
 		}
+	}
 
-		ip = entryParsed.Value
-		return nil
-	})
+	s.open = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.openCancel = cancel
+
+	go s.sweep(ctx)
+	if s.primary != nil {
+		go s.follow(ctx)
+	}
 
-	return ip, err
+	return nil
 }
 
-func (s *Store) ResolveIP(ip net.IP) (Entry, string, error) {
-	var entryParsed Entry
-	var idStr string
+// OpenReadOnly opens the store for reading, leaving the database as it is: expired entries are skipped instead of
+// removed, the serial isn't bumped and nothing is swept or replicated
+func (s *Store) OpenReadOnly() error {
+	if s.open { // Idempotent
+		return nil
+	}
 
-	err := s.AssertDB()
+	s.openLock.Lock()
+	defer s.openLock.Unlock()
+
+	err := s.backend.Open()
 	if err != nil {
-		return entryParsed, idStr, err
+		return err
 	}
 
-	err = s.db.View(func(tx *bolt.Tx) error {
-		bDNS := tx.Bucket([]byte("dns"))
-		bIP := tx.Bucket([]byte("dns4ip"))
+	var serial uint32
+	err = s.backend.View(func(tx BackendTx) error {
+		var err error
+		serial, err = tx.GetSerial()
+		return err
+	})
+	if err != nil {
+		_ = s.backend.Close()
+		return err
+	}
 
-		id := bIP.Get(ip)
-		if id == nil {
+	atomic.StoreUint32(&s.serial, serial)
+	s.openCancel = func() {}
+	s.open = true
+
+	return nil
+}
+
+func (s *Store) Close() error {
+	if !s.open {
+		return nil
+	}
+
+	s.openLock.Lock()
+	defer s.openLock.Unlock()
+
+	s.openCancel()
+	s.openCancel = nil
+
+	err := s.backend.Close()
+	if err != nil {
+		return err
+	}
+
+	s.open = false
+
+	return nil
+}
+
+// generateID returns a free id from the providers
+func (s *Store) generateID(tx *storeTx) (string, error) {
+	for try := 0; try < 49; try++ {
+		id, err := s.providers[try%len(s.providers)].GetID()
+		if err != nil {
+			return "", err
+		}
+
+		existingEntry, err := tx.liveEntry(id)
+		if err != nil {
+			return "", err
+		}
+
+		if existingEntry == nil && !s.IsReserved(id) {
+			return id, nil
+		}
+	}
+
+	return "", errors.New("could not find any free id")
+}
+
+// AddEntry registers the address of client or renews its existing entry.
+// name optionally requests the id of the entry, if it is reserved or taken an id from the providers is used
+// for new entries, while existing entries keep theirs.
+func (s *Store) AddEntry(client Auth, name string) (Entry, string, error) {
+	var entry Entry
+	var id string
+
+	err := s.AssertDB()
+	if err != nil {
+		return entry, id, err
+	}
+
+	if s.primary != nil {
+		res, err := s.forward(forwardCall("add", name, client))
+		return res.entry(), res.Name, err
+	}
+
+	ipaddr := normalizeIP(client.IP)
+	if ipaddr == nil {
+		return entry, id, net.InvalidAddrError("invalid address")
+	}
+
+	name = s.ParseID(name)
+	if name != "" {
+		err := ValidateName(name)
+		if err != nil {
+			return entry, id, err
+		}
+	}
+
+	err = s.change(client, func(tx *storeTx) error {
+		existingID, err := tx.GetID(ipaddr)
+		if err != nil {
+			return err
+		}
+		if existingID != "" {
+			existingEntry, err := tx.liveEntry(existingID)
+			if err != nil {
+				return err
+			}
+			if existingEntry != nil {
+				entry = *existingEntry
+			} else {
+				existingID = ""
+			}
+		}
+		if existingID == "" {
+			err := tx.checkQuota(ipaddr)
+			if err != nil {
+				return err
+			}
+		}
+
+		id = existingID
+		if id == "" || (name != "" && name != id) {
+			newID := ""
+			if name != "" && !s.IsReserved(name) {
+				taken, err := tx.liveEntry(name)
+				if err != nil {
+					return err
+				}
+				if taken == nil {
+					newID = name
+				}
+			}
+			if newID == "" && id == "" {
+				newID, err = s.generateID(tx)
+				if err != nil {
+					return err
+				}
+			}
+
+			if newID != "" {
+				if id == "" {
+					entry.Created = time.Now()
+				} else { // rename
+					err := tx.DeleteEntry(id)
+					if err != nil {
+						return err
+					}
+					tx.emit(EventRemoved, ReasonRenamed, id, &entry)
+				}
+
+				id = newID
+				for _, ip := range append(entry.HeldIPs(), ipaddr) {
+					err := tx.PutID(ip, id)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		// entries from before management tokens get one on their next registration
+		if entry.TokenHash == "" {
+			err := entry.issueToken()
+			if err != nil {
+				return err
+			}
+		}
+
+		entry.Expires = s.renewedExpiry(entry)
+		entry.SetIP(ipaddr)
+
+		if id == existingID {
+			tx.emit(EventChanged, ReasonRenewed, id, &entry)
+		} else {
+			tx.emit(EventAdded, ReasonRegistered, id, &entry)
+		}
+
+		return tx.PutEntry(id, &entry)
+	})
+	if err != nil {
+		return entry, "", err
+	}
+
+	return entry, id + "." + s.Config.Domain, nil
+}
+
+// lookupManaged returns the entry id, or the entry of the client address if id is empty, after checking that auth may manage it
+func lookupManaged(tx BackendTx, id string, auth Auth) (string, Entry, error) {
+	var entry Entry
+
+	notFound := ErrNotFound
+	if id == "" {
+		var err error
+		id, err = tx.GetID(normalizeIP(auth.IP))
+		if err != nil {
+			return id, entry, err
+		}
+		notFound = ErrNoEntry
+	}
+
+	existingEntry, err := getLiveEntry(tx, id)
+	if err != nil {
+		return id, entry, err
+	}
+	if existingEntry == nil {
+		return id, entry, notFound
+	}
+	entry = *existingEntry
+
+	if auth.Key != "" {
+		if auth.Key != id {
+			return id, entry, ErrNotAllowed
+		}
+	} else if auth.Token != "" {
+		if !entry.CheckToken(auth.Token) {
+			return id, entry, ErrNotAllowed
+		}
+	} else if !entry.HoldsIP(auth.IP) {
+		return id, entry, ErrNotAllowed
+	}
+
+	return id, entry, nil
+}
+
+// RenewEntry extends the expiry of the entry id by the TTL, up to its maximum lifetime.
+// If id is empty the entry of the client address is renewed.
+func (s *Store) RenewEntry(id string, auth Auth) (Entry, string, error) {
+	var entry Entry
+
+	err := s.AssertDB()
+	if err != nil {
+		return entry, "", err
+	}
+
+	if s.primary != nil {
+		res, err := s.forward(forwardCall("renew", id, auth))
+		return res.entry(), res.Name, err
+	}
+
+	id = s.ParseID(id)
+
+	err = s.change(auth, func(tx *storeTx) error {
+		var err error
+		id, entry, err = lookupManaged(tx, id, auth)
+		if err != nil {
+			return err
+		}
+
+		maxExpires := s.MaxExpires(entry)
+		if !maxExpires.IsZero() && !maxExpires.After(entry.Expires) {
+			return ErrMaxLifetime
+		}
+
+		entry.Expires = s.renewedExpiry(entry)
+		tx.emit(EventChanged, ReasonRenewed, id, &entry)
+
+		return tx.PutEntry(id, &entry)
+	})
+	if err != nil {
+		return entry, "", err
+	}
+
+	return entry, id + "." + s.Config.Domain, nil
+}
+
+// DeleteEntry releases the entry id, or the entry of the client address if id is empty, removing it and all of its addresses at once.
+func (s *Store) DeleteEntry(id string, auth Auth) (string, error) {
+	err := s.AssertDB()
+	if err != nil {
+		return "", err
+	}
+
+	if s.primary != nil {
+		res, err := s.forward(forwardCall("delete", id, auth))
+		return res.Name, err
+	}
+
+	id = s.ParseID(id)
+
+	err = s.change(auth, func(tx *storeTx) error {
+		var entry Entry
+		var err error
+		id, entry, err = lookupManaged(tx, id, auth)
+		if err != nil {
+			return err
+		}
+
+		tx.emit(EventRemoved, ReasonReleased, id, &entry)
+
+		return removeEntry(tx, id, &entry)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return id + "." + s.Config.Domain, nil
+}
+
+// UpdateEntry points the entry id, or the entry of the client address if id is empty, to ips,
+// replacing its previous addresses of the same families.
+// Addresses of other entries can only be taken over by the client holding them.
+func (s *Store) UpdateEntry(id string, auth Auth, ips ...net.IP) (Entry, string, error) {
+	var entry Entry
+
+	err := s.AssertDB()
+	if err != nil {
+		return entry, "", err
+	}
+
+	if s.primary != nil {
+		call := forwardCall("update", id, auth)
+		call.IPs = ips
+		res, err := s.forward(call)
+		return res.entry(), res.Name, err
+	}
+
+	id = s.ParseID(id)
+	err = normalizeIPs(ips)
+	if err != nil {
+		return entry, "", err
+	}
+
+	err = s.change(auth, func(tx *storeTx) error {
+		var err error
+		id, entry, err = lookupManaged(tx, id, auth)
+		if err != nil {
+			return err
+		}
+
+		err = updateIPs(tx, id, &entry, auth, ips)
+		if err != nil {
+			return err
+		}
+		tx.emit(EventChanged, ReasonUpdated, id, &entry)
+
+		return tx.PutEntry(id, &entry)
+	})
+	if err != nil {
+		return entry, "", err
+	}
+
+	return entry, id + "." + s.Config.Domain, nil
+}
+
+// UpdateRenewEntry points the entry id to ips like UpdateEntry and renews it like RenewEntry, as a single change.
+// Entries at their maximum lifetime are only updated, and entries already pointing to ips only renewed.
+func (s *Store) UpdateRenewEntry(id string, auth Auth, ips ...net.IP) (Entry, string, error) {
+	var entry Entry
+
+	err := s.AssertDB()
+	if err != nil {
+		return entry, "", err
+	}
+
+	if s.primary != nil {
+		call := forwardCall("update_renew", id, auth)
+		call.IPs = ips
+		res, err := s.forward(call)
+		return res.entry(), res.Name, err
+	}
+
+	id = s.ParseID(id)
+	err = normalizeIPs(ips)
+	if err != nil {
+		return entry, "", err
+	}
+
+	err = s.change(auth, func(tx *storeTx) error {
+		var err error
+		id, entry, err = lookupManaged(tx, id, auth)
+		if err != nil {
+			return err
+		}
+
+		reason := ReasonRenewed
+		for _, ip := range ips {
+			if !entry.HasIP(ip) || (ip.Equal(auth.IP) && !entry.HoldsIP(ip)) {
+				reason = ReasonUpdated
+			}
+		}
+		if reason == ReasonUpdated {
+			err = updateIPs(tx, id, &entry, auth, ips)
+			if err != nil {
+				return err
+			}
+		}
+
+		maxExpires := s.MaxExpires(entry)
+		if !maxExpires.IsZero() && !maxExpires.After(entry.Expires) {
+			if reason == ReasonRenewed { // nothing changes
+				return nil
+			}
+		} else {
+			entry.Expires = s.renewedExpiry(entry)
+		}
+		tx.emit(EventChanged, reason, id, &entry)
+
+		return tx.PutEntry(id, &entry)
+	})
+	if err != nil {
+		return entry, "", err
+	}
+
+	return entry, id + "." + s.Config.Domain, nil
+}
+
+// normalizeIPs normalizes the addresses of ips in place
+func normalizeIPs(ips []net.IP) error {
+	for i, ip := range ips {
+		ips[i] = normalizeIP(ip)
+		if ips[i] == nil {
+			return net.InvalidAddrError("invalid address")
+		}
+	}
+
+	return nil
+}
+
+// updateIPs attaches ips to the entry id, taking them over from other entries only if the client holds them.
+// Addresses the client doesn't send from are only claimed.
+func updateIPs(tx *storeTx, id string, entry *Entry, auth Auth, ips []net.IP) error {
+	for _, ip := range ips {
+		owner, err := tx.GetID(ip)
+		if err != nil {
+			return err
+		}
+
+		if !ip.Equal(auth.IP) {
+			if owner != "" && owner != id {
+				return ErrAddressInUse
+			}
+
+			err := claimIP(tx, id, entry, ip)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = tx.checkQuota(ip)
+		if err != nil {
+			return err
+		}
+		err = attachIP(tx, id, entry, ip)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ResetToken issues a new management token for the entry id, or the entry of the client address if id is empty,
+// invalidating the previous one.
+func (s *Store) ResetToken(id string, auth Auth) (Entry, string, error) {
+	var entry Entry
+
+	err := s.AssertDB()
+	if err != nil {
+		return entry, "", err
+	}
+
+	if s.primary != nil {
+		res, err := s.forward(forwardCall("token", id, auth))
+		return res.entry(), res.Name, err
+	}
+
+	id = s.ParseID(id)
+
+	err = s.change(auth, func(tx *storeTx) error {
+		var err error
+		id, entry, err = lookupManaged(tx, id, auth)
+		if err != nil {
+			return err
+		}
+
+		err = entry.issueToken()
+		if err != nil {
+			return err
+		}
+		tx.emit(EventChanged, ReasonKeyIssued, id, &entry)
+
+		return tx.PutEntry(id, &entry)
+	})
+	if err != nil {
+		return entry, "", err
+	}
+
+	return entry, id + "." + s.Config.Domain, nil
+}
+
+func (s *Store) ResolveEntry(id string) (*Entry, error) {
+	err := s.AssertDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var entry *Entry
+
+	err = s.backend.View(func(tx BackendTx) error {
+		var err error
+		entry, err = getLiveEntry(tx, id)
+		return err
+	})
+
+	return entry, err
+}
+
+func (s *Store) ResolveIP(ip net.IP) (Entry, string, error) {
+	var entryParsed Entry
+	var idStr string
+
+	err := s.AssertDB()
+	if err != nil {
+		return entryParsed, idStr, err
+	}
+
+	err = s.backend.View(func(tx BackendTx) error {
+		id, err := tx.GetID(normalizeIP(ip))
+		if err != nil {
+			return err
+		}
+		if id == "" {
 			return nil
 		}
 
-		idStr = string(id) + "." + s.Config.Domain
-		entry := bDNS.Get(id)
+		entry, err := getLiveEntry(tx, id)
+		if err != nil {
+			return err
+		}
 		if entry == nil {
 			return nil
 		}
 
-		err := json.Unmarshal(entry, &entryParsed)
+		idStr = id + "." + s.Config.Domain
+		entryParsed = *entry
+		return nil
+	})
+
+	return entryParsed, idStr, err
+}
+
+// ForEach calls fn for every live entry with its DNS name
+func (s *Store) ForEach(fn func(name string, entry Entry) error) error {
+	_, err := s.ForEachSerial(fn)
+	return err
+}
+
+// ForEachSerial is ForEach, returning the serial of the zone the entries belong to
+func (s *Store) ForEachSerial(fn func(name string, entry Entry) error) (uint32, error) {
+	err := s.AssertDB()
+	if err != nil {
+		return 0, err
+	}
+
+	var serial uint32
+	now := time.Now()
+	err = s.backend.View(func(tx BackendTx) error {
+		var err error
+		serial, err = tx.GetSerial()
+		if err != nil {
+			return err
+		}
+
+		return tx.ForEach(func(id string, entry *Entry) error {
+			if entry.Expired(now) {
+				return nil
+			}
+
+			return fn(id+"."+s.Config.Domain, *entry)
+		})
+	})
+
+	return serial, err
+}
+
+// Backup writes a consistent snapshot of the store to w while it is in use, if the backend supports it
+func (s *Store) Backup(w io.Writer) (int64, error) {
+	err := s.AssertDB()
+	if err != nil {
+		return 0, err
+	}
+
+	backend, ok := s.backend.(BackupBackend)
+	if !ok {
+		return 0, ErrBackupUnsupported
+	}
+
+	return backend.Backup(w)
+}
+
+// randomToken returns a random lowercase base32 string encoding size bytes
+func randomToken(size int) (string, error) {
+	b := make([]byte, size)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)), nil
+}
+
+// detachIP removes ipaddr from the entry id, deleting the entry once it has no addresses left
+func detachIP(tx *storeTx, id string, ipaddr net.IP) error {
+	err := tx.DeleteID(ipaddr)
+	if err != nil {
+		return err
+	}
+
+	entry, err := tx.GetEntry(id)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return nil
+	}
+
+	if entry.Value.Equal(ipaddr) {
+		entry.Value = nil
+	}
+	if entry.Value4.Equal(ipaddr) {
+		entry.Value4 = nil
+	}
+
+	if len(entry.IPs()) == 0 {
+		tx.emit(EventRemoved, ReasonAddressTaken, id, entry)
+		return tx.DeleteEntry(id)
+	}
+
+	tx.emit(EventChanged, ReasonAddressTaken, id, entry)
+	return tx.PutEntry(id, entry)
+}
+
+// attachIP points ipaddr to the entry id, taking it away from any other entry
+// and replacing the previous address of the same family
+func attachIP(tx *storeTx, id string, entry *Entry, ipaddr net.IP) error {
+	oldID, err := tx.GetID(ipaddr)
+	if err != nil {
+		return err
+	}
+	if oldID != "" && oldID != id {
+		err := detachIP(tx, oldID, ipaddr)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = releaseOldIP(tx, id, entry, ipaddr)
+	if err != nil {
+		return err
+	}
+
+	entry.SetIP(ipaddr)
+
+	return tx.PutID(ipaddr, id)
+}
+
+// claimIP points the entry id to ipaddr without adding it to the reverse index, replacing the previous address
+// of the same family. Addresses the entry holds already stay held.
+func claimIP(tx *storeTx, id string, entry *Entry, ipaddr net.IP) error {
+	if entry.HoldsIP(ipaddr) {
+		return nil
+	}
+
+	err := releaseOldIP(tx, id, entry, ipaddr)
+	if err != nil {
+		return err
+	}
+
+	entry.ClaimIP(ipaddr)
+
+	return nil
+}
+
+// releaseOldIP removes the address of the entry id of the family of ipaddr from the reverse index, if it held it
+func releaseOldIP(tx *storeTx, id string, entry *Entry, ipaddr net.IP) error {
+	old := entry.Value
+	if len(ipaddr) == net.IPv4len {
+		old = entry.Value4
+	}
+	if old == nil || old.Equal(ipaddr) || !entry.HoldsIP(old) {
+		return nil
+	}
+
+	owner, err := tx.GetID(normalizeIP(old))
+	if err != nil || owner != id {
+		return err
+	}
+
+	return tx.DeleteID(normalizeIP(old))
+}
+
+// CreateLink issues a short-lived code that attaches another address to the entry of ipaddr when passed to Link
+func (s *Store) CreateLink(ipaddr net.IP) (string, time.Time, error) {
+	var id string
+	var expires time.Time
+
+	err := s.AssertDB()
+	if err != nil {
+		return "", expires, err
+	}
+
+	if s.primary != nil {
+		res, err := s.forward(forwardCall("create_link", "", Auth{IP: ipaddr}))
+		return res.Name, res.Expires, err
+	}
+
+	err = s.backend.View(func(tx BackendTx) error {
+		var err error
+		id, err = tx.GetID(normalizeIP(ipaddr))
+		if err != nil {
+			return err
+		}
+		if id == "" {
+			return ErrNoEntry
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", expires, err
+	}
+
+	code, err := randomToken(5)
+	if err != nil {
+		return "", expires, err
+	}
+
+	now := time.Now()
+	expires = now.Add(s.LinkTTL())
+
+	s.linksLock.Lock()
+	defer s.linksLock.Unlock()
+
+	for c, l := range s.links {
+		if l.expires.Before(now) {
+			delete(s.links, c)
+		}
+	}
+
+	s.links[code] = link{
+		id:      id,
+		expires: expires,
+	}
+
+	return code, expires, nil
+}
+
+// Link attaches the address of client to the entry the code was issued for.
+// Both address families can be held by one entry, an existing address of the same family is replaced.
+func (s *Store) Link(code string, client Auth) (Entry, string, error) {
+	var entry Entry
+	var id string
+
+	err := s.AssertDB()
+	if err != nil {
+		return entry, id, err
+	}
+
+	if s.primary != nil {
+		res, err := s.forward(forwardCall("link", code, client))
+		return res.entry(), res.Name, err
+	}
+
+	ipaddr := normalizeIP(client.IP)
+	if ipaddr == nil {
+		return entry, id, net.InvalidAddrError("invalid address")
+	}
+
+	s.linksLock.Lock()
+	l, ok := s.links[strings.ToLower(code)]
+	delete(s.links, strings.ToLower(code))
+	s.linksLock.Unlock()
+
+	if !ok || l.expires.Before(time.Now()) {
+		return entry, id, ErrInvalidLink
+	}
+
+	err = s.change(client, func(tx *storeTx) error {
+		existingEntry, err := getLiveEntry(tx, l.id)
+		if err != nil {
+			return err
+		}
+		if existingEntry == nil {
+			return ErrInvalidLink
+		}
+		entry = *existingEntry
+
+		err = tx.checkQuota(ipaddr)
+		if err != nil {
+			return err
+		}
+		err = attachIP(tx, l.id, &entry, ipaddr)
 		if err != nil {
 			return err
 		}
 
+		err = tx.PutEntry(l.id, &entry)
+		if err != nil {
+			return err
+		}
+		tx.emit(EventChanged, ReasonLinked, l.id, &entry)
+
+		id = l.id + "." + s.Config.Domain
+
 		return nil
 	})
 
-	return entryParsed, idStr, err
+	return entry, id, err
 }
 
+// GetSerial returns the SOA serial, which is incremented with every change of the zone
 func (s *Store) GetSerial() uint32 {
-	return uint32(s.serial)
+	return atomic.LoadUint32(&s.serial)
 }
@@ -0,0 +1,232 @@
+package lib
+
+import (
+	"github.com/mkg20001/give-me-dns/lib/idprov"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testStore(t *testing.T, config *StoreConfig) *Store {
+	config.Domain = "give-me-dns.net"
+	store := NewStore(config, NewMemoryBackend(), []idprov.IDProv{idprov.ProvideRandomID(5)})
+	assert.NoError(t, store.Open())
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+
+	return store
+}
+
+func TestStoreExpiry(t *testing.T) {
+	store := testStore(t, &StoreConfig{
+		TTL:           100 * time.Millisecond,
+		SweepInterval: 50 * time.Millisecond,
+	})
+
+	ip := net.ParseIP("2001:db8::1")
+	_, name, err := store.AddEntry(Auth{IP: ip}, "")
+	assert.NoError(t, err)
+	id := store.ParseID(name)
+
+	entry, err := store.ResolveEntry(id)
+	assert.NoError(t, err)
+	assert.NotNil(t, entry)
+
+	time.Sleep(100 * time.Millisecond)
+
+	// expired entries don't resolve even before they are swept
+	entry, err = store.ResolveEntry(id)
+	assert.NoError(t, err)
+	assert.Nil(t, entry)
+
+	_, name, err = store.ResolveIP(ip)
+	assert.NoError(t, err)
+	assert.Empty(t, name)
+
+	time.Sleep(100 * time.Millisecond)
+
+	err = store.backend.View(func(tx BackendTx) error {
+		entry, err := tx.GetEntry(id)
+		assert.Nil(t, entry)
+		return err
+	})
+	assert.NoError(t, err)
+}
+
+func TestStoreSerial(t *testing.T) {
+	config := &StoreConfig{
+		Domain: "give-me-dns.net",
+		TTL:    time.Hour,
+	}
+	file := filepath.Join(t.TempDir(), "db")
+	store := NewStore(config, NewBoltBackend(file), []idprov.IDProv{idprov.ProvideRandomID(5)})
+	assert.NoError(t, store.Open())
+
+	// the serial starts at the time to continue after the expiry based serials of older versions
+	serial := store.GetSerial()
+	assert.GreaterOrEqual(t, serial, uint32(time.Now().Add(-time.Minute).Unix()))
+
+	ip := net.ParseIP("2001:db8::1")
+	_, name, err := store.AddEntry(Auth{IP: ip}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, serial+1, store.GetSerial())
+
+	_, _, err = store.RenewEntry(name, Auth{IP: ip})
+	assert.NoError(t, err)
+	assert.Equal(t, serial+2, store.GetSerial())
+
+	// failed changes keep the serial, new tokens are replicated like every other change
+	_, err = store.DeleteEntry("missing", Auth{IP: ip})
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, serial+2, store.GetSerial())
+	_, _, err = store.ResetToken(name, Auth{IP: ip})
+	assert.NoError(t, err)
+	assert.Equal(t, serial+3, store.GetSerial())
+
+	_, err = store.DeleteEntry(name, Auth{IP: ip})
+	assert.NoError(t, err)
+	assert.Equal(t, serial+4, store.GetSerial())
+
+	assert.NoError(t, store.Close())
+
+	// the serial is persisted and doesn't go backwards after a restart
+	store = NewStore(config, NewBoltBackend(file), []idprov.IDProv{idprov.ProvideRandomID(5)})
+	assert.NoError(t, store.Open())
+	assert.Equal(t, serial+4, store.GetSerial())
+	assert.NoError(t, store.Close())
+}
+
+func TestStoreEvents(t *testing.T) {
+	store := testStore(t, &StoreConfig{
+		TTL:           100 * time.Millisecond,
+		SweepInterval: 50 * time.Millisecond,
+	})
+
+	events := make(chan Event, 10)
+	unsubscribe := store.Subscribe(func(event Event) {
+		events <- event
+	})
+	defer unsubscribe()
+
+	ip := net.ParseIP("2001:db8::1")
+	entry, name, err := store.AddEntry(Auth{IP: ip}, "")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, entry.Token)
+
+	event := <-events
+	assert.Equal(t, EventAdded, event.Type)
+	assert.Equal(t, ReasonRegistered, event.Reason)
+	assert.Equal(t, name, event.Name)
+	assert.Equal(t, store.ParseID(name), event.ID)
+	assert.Equal(t, store.GetSerial(), event.Serial)
+	assert.True(t, event.Entry.HasIP(ip))
+	assert.Empty(t, event.Entry.Token)
+
+	_, _, err = store.RenewEntry(name, Auth{IP: ip})
+	assert.NoError(t, err)
+	event = <-events
+	assert.Equal(t, EventChanged, event.Type)
+	assert.Equal(t, ReasonRenewed, event.Reason)
+
+	_, err = store.DeleteEntry(name, Auth{IP: ip})
+	assert.NoError(t, err)
+	event = <-events
+	assert.Equal(t, EventRemoved, event.Type)
+	assert.Equal(t, ReasonReleased, event.Reason)
+	assert.Equal(t, name, event.Name)
+
+	// the sweeper reports what it removed
+	_, name, err = store.AddEntry(Auth{IP: ip}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, ReasonRegistered, (<-events).Reason)
+
+	select {
+	case event = <-events:
+		assert.Equal(t, EventRemoved, event.Type)
+		assert.Equal(t, ReasonExpired, event.Reason)
+		assert.Equal(t, name, event.Name)
+	case <-time.After(time.Second):
+		t.Fatal("entry was not swept")
+	}
+}
+
+func TestUpdateRenewEntry(t *testing.T) {
+	store := testStore(t, &StoreConfig{
+		TTL: time.Hour,
+	})
+
+	ip := net.ParseIP("2001:db8::1")
+	entry, name, err := store.AddEntry(Auth{IP: ip}, "")
+	assert.NoError(t, err)
+
+	events := make(chan Event, 10)
+	unsubscribe := store.Subscribe(func(event Event) {
+		events <- event
+	})
+	defer unsubscribe()
+
+	// updating and renewing is a single change
+	serial := store.GetSerial()
+	updated, _, err := store.UpdateRenewEntry(name, Auth{IP: ip, Token: entry.Token}, net.ParseIP("192.0.2.1"))
+	assert.NoError(t, err)
+	assert.True(t, updated.HasIP(net.ParseIP("192.0.2.1")))
+	assert.True(t, updated.Expires.After(entry.Expires))
+	assert.Equal(t, serial+1, store.GetSerial())
+	assert.Equal(t, ReasonUpdated, (<-events).Reason)
+
+	_, _, err = store.UpdateRenewEntry(name, Auth{IP: ip, Token: entry.Token}, net.ParseIP("192.0.2.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, serial+2, store.GetSerial())
+	assert.Equal(t, ReasonRenewed, (<-events).Reason)
+	assert.Empty(t, events)
+}
+
+func TestClaimedAddresses(t *testing.T) {
+	store := testStore(t, &StoreConfig{
+		TTL: time.Hour,
+	})
+
+	client := net.ParseIP("2001:db8::1")
+	victim := net.ParseIP("192.0.2.1")
+	entry, name, err := store.AddEntry(Auth{IP: client}, "claiming")
+	assert.NoError(t, err)
+
+	// addresses the client doesn't send from are served, but not indexed
+	claimed, _, err := store.UpdateRenewEntry(name, Auth{IP: client, Token: entry.Token}, victim)
+	assert.NoError(t, err)
+	assert.True(t, claimed.HasIP(victim))
+	assert.False(t, claimed.HoldsIP(victim))
+	_, id, err := store.ResolveIP(victim)
+	assert.NoError(t, err)
+	assert.Empty(t, id)
+
+	// so they don't manage the entry, and their holder registers a name of its own
+	_, _, err = store.RenewEntry(name, Auth{IP: victim})
+	assert.ErrorIs(t, err, ErrNotAllowed)
+	own, ownName, err := store.AddEntry(Auth{IP: victim}, "")
+	assert.NoError(t, err)
+	assert.NotEqual(t, name, ownName)
+	assert.NotEmpty(t, own.Token)
+	_, id, err = store.ResolveIP(victim)
+	assert.NoError(t, err)
+	assert.Equal(t, ownName, id)
+
+	// addresses held by other entries can't be claimed
+	_, err = store.DeleteEntry(ownName, Auth{IP: victim})
+	assert.NoError(t, err)
+	_, ownName, err = store.AddEntry(Auth{IP: net.ParseIP("192.0.2.2")}, "")
+	assert.NoError(t, err)
+	_, _, err = store.UpdateRenewEntry(name, Auth{IP: client, Token: entry.Token}, net.ParseIP("192.0.2.2"))
+	assert.ErrorIs(t, err, ErrAddressInUse)
+
+	// sending from a claimed address makes it held
+	held, _, err := store.UpdateRenewEntry(name, Auth{IP: victim, Token: entry.Token}, victim)
+	assert.NoError(t, err)
+	assert.True(t, held.HoldsIP(victim))
+	_, id, err = store.ResolveIP(victim)
+	assert.NoError(t, err)
+	assert.Equal(t, name, id)
+}
@@ -0,0 +1,260 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/getsentry/sentry-go"
+	"github.com/miekg/dns"
+	"hash"
+	"log"
+	"net"
+	"strings"
+)
+
+// FrontendDNS is recorded in the history for changes by DNS UPDATE
+const FrontendDNS = "dns"
+
+// IssueKey issues a new TSIG key for DNS UPDATEs of the entry id, or the entry of the client address if id is empty,
+// invalidating the previous one. The key is named like the entry, its secret is returned in the entry.
+func (s *Store) IssueKey(id string, auth Auth) (Entry, string, error) {
+	var entry Entry
+
+	err := s.AssertDB()
+	if err != nil {
+		return entry, "", err
+	}
+
+	if s.primary != nil {
+		res, err := s.forward(forwardCall("key", id, auth))
+		return res.entry(), res.Name, err
+	}
+
+	id = s.ParseID(id)
+
+	err = s.change(auth, func(tx *storeTx) error {
+		var err error
+		id, entry, err = lookupManaged(tx, id, auth)
+		if err != nil {
+			return err
+		}
+
+		secret := make([]byte, 32)
+		_, err = rand.Read(secret)
+		if err != nil {
+			return err
+		}
+		entry.TSIGSecret = base64.StdEncoding.EncodeToString(secret)
+		tx.emit(EventChanged, ReasonKeyIssued, id, &entry)
+
+		return tx.PutEntry(id, &entry)
+	})
+	if err != nil {
+		return entry, "", err
+	}
+
+	return entry, id + "." + s.Config.Domain, nil
+}
+
+// tsigProvider verifies the TSIG keys of the transfers and those of the entries, named like the entry
+type tsigProvider struct {
+	transfer map[string]string
+	store    *Store
+}
+
+func (p *tsigProvider) secret(name string) (string, error) {
+	name = strings.ToLower(name)
+	if secret, ok := p.transfer[name]; ok {
+		return secret, nil
+	}
+
+	if id, ok := strings.CutSuffix(name, "."+p.store.Domain()+"."); ok {
+		entry, err := p.store.ResolveEntry(id)
+		if err != nil {
+			return "", err
+		}
+		if entry != nil && entry.TSIGSecret != "" {
+			return entry.TSIGSecret, nil
+		}
+	}
+
+	return "", dns.ErrSecret
+}
+
+func (p *tsigProvider) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	secret, err := p.secret(t.Hdr.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	var h hash.Hash
+	switch dns.CanonicalName(t.Algorithm) {
+	case dns.HmacSHA256:
+		h = hmac.New(sha256.New, raw)
+	case dns.HmacSHA512:
+		h = hmac.New(sha512.New, raw)
+	default:
+		return nil, dns.ErrKeyAlg
+	}
+	h.Write(msg)
+
+	return h.Sum(nil), nil
+}
+
+func (p *tsigProvider) Verify(msg []byte, t *dns.TSIG) error {
+	expected, err := p.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+
+	mac, err := hex.DecodeString(t.MAC)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expected, mac) {
+		return dns.ErrSig
+	}
+
+	return nil
+}
+
+// acceptMsg accepts UPDATE messages besides those accepted by default, whose sections can hold any number of records
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	if opcode := int(dh.Bits>>11) & 0xF; opcode == dns.OpcodeUpdate && dh.Bits&(1<<15) == 0 {
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+
+		return dns.MsgAccept
+	}
+
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// errUpdateRefused is returned for updates that can't be applied to an entry
+var errUpdateRefused = errors.New("update refused")
+
+// updateAddresses returns the addresses of entry after applying the update section of r, which has to change only name
+func updateAddresses(r *dns.Msg, name string, entry *Entry) ([]net.IP, error) {
+	added := make(map[uint16]net.IP)
+	deleted := make(map[uint16]bool)
+
+	for _, rr := range r.Ns {
+		hdr := rr.Header()
+		if strings.ToLower(hdr.Name) != name {
+			return nil, errUpdateRefused
+		}
+
+		switch hdr.Class {
+		case dns.ClassINET: // add to an RRset
+			switch rr := rr.(type) {
+			case *dns.A:
+				added[dns.TypeA] = rr.A
+			case *dns.AAAA:
+				added[dns.TypeAAAA] = rr.AAAA
+			default:
+				return nil, errUpdateRefused
+			}
+		case dns.ClassANY, dns.ClassNONE: // delete an RRset or an RR of it
+			switch hdr.Rrtype {
+			case dns.TypeA, dns.TypeAAAA:
+				deleted[hdr.Rrtype] = true
+			case dns.TypeANY:
+				deleted[dns.TypeA] = true
+				deleted[dns.TypeAAAA] = true
+			default:
+				return nil, errUpdateRefused
+			}
+		default:
+			return nil, errUpdateRefused
+		}
+	}
+
+	// entries always have their addresses replaced, as one without any has to be released instead
+	current := map[uint16]net.IP{dns.TypeA: entry.Value4, dns.TypeAAAA: entry.Value}
+	for rrtype := range deleted {
+		if added[rrtype] == nil && current[rrtype] != nil {
+			return nil, errUpdateRefused
+		}
+	}
+
+	var ips []net.IP
+	for _, rrtype := range []uint16{dns.TypeAAAA, dns.TypeA} {
+		if ip := added[rrtype]; ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+
+	return ips, nil
+}
+
+// handleUpdate applies a DNS UPDATE (RFC 2136) signed with the TSIG key of an entry, which may only replace the addresses of that entry
+func handleUpdate(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg, store *Store) {
+	if len(r.Question) != 1 || strings.ToLower(r.Question[0].Name) != store.Domain()+"." || r.Question[0].Qtype != dns.TypeSOA {
+		m.Rcode = dns.RcodeNotAuth
+		return
+	}
+
+	tsig := r.IsTsig()
+	if tsig == nil {
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+	if w.TsigStatus() != nil {
+		m.Rcode = dns.RcodeNotAuth
+		return
+	}
+
+	name := strings.ToLower(tsig.Hdr.Name)
+	id, ok := strings.CutSuffix(name, "."+store.Domain()+".")
+	if !ok {
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+
+	// prerequisites are not supported
+	if len(r.Answer) > 0 {
+		m.Rcode = dns.RcodeNotImplemented
+		return
+	}
+
+	entry, err := store.ResolveEntry(id)
+	if err != nil || entry == nil {
+		m.Rcode = dns.RcodeNotAuth
+		return
+	}
+
+	ips, err := updateAddresses(r, name, entry)
+	if err != nil {
+		log.Printf("Refused update of %s: %s", name, err)
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+	if len(ips) == 0 {
+		return
+	}
+
+	client := remoteIP(w)
+	_, dnsName, err := store.UpdateEntry(id, Auth{IP: client, Frontend: FrontendDNS, Key: id}, ips...)
+	switch {
+	case err == nil:
+		log.Printf("Updated entry %s - IP %s\n", dnsName, client)
+	case errors.Is(err, ErrAddressInUse), errors.Is(err, ErrNotAllowed):
+		m.Rcode = dns.RcodeRefused
+	case errors.Is(err, ErrNotFound):
+		m.Rcode = dns.RcodeNotAuth
+	default:
+		sentry.CaptureException(err)
+		log.Printf("Failed to update %s: %s", name, err)
+		m.Rcode = dns.RcodeServerFailure
+	}
+}
@@ -0,0 +1,307 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+const DefaultWebhookExpiringIn = 1 * time.Hour
+const DefaultWebhookRetries = 5
+const DefaultWebhookRetryDelay = 1 * time.Second
+const DefaultWebhookTimeout = 10 * time.Second
+
+// webhookQueueSize is the number of requests waiting per target, further events are dropped while it is full
+const webhookQueueSize = 100
+
+const (
+	WebhookRegistered = "registered"
+	WebhookRenewed    = "renewed"
+	WebhookUpdated    = "updated"
+	WebhookReleased   = "released"
+	WebhookExpiring   = "expiring"
+	WebhookExpired    = "expired"
+	// WebhookRenamed is sent for the previous name of a renamed entry, the new name is registered
+	WebhookRenamed = "renamed"
+	// WebhookAddressTaken is sent for entries removed as their last address was taken by another entry
+	WebhookAddressTaken = "address_taken"
+)
+
+// WebhookPayload is the body of the webhook requests
+type WebhookPayload struct {
+	Event     string   `json:"event"`
+	Name      string   `json:"name"`
+	Addresses []net.IP `json:"addresses"`
+	Expires   string   `json:"expires"`
+	Time      string   `json:"time"`
+}
+
+type webhook struct {
+	config *WebhookConfig
+	client *http.Client
+	queue  chan WebhookPayload
+	// notified holds the expiry of the entries the expiring event was sent for, only used by scanExpiring
+	notified map[string]time.Time
+}
+
+func newWebhook(config *WebhookConfig) *webhook {
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = DefaultWebhookTimeout
+	}
+
+	return &webhook{
+		config:   config,
+		client:   &http.Client{Timeout: timeout},
+		queue:    make(chan WebhookPayload, webhookQueueSize),
+		notified: make(map[string]time.Time),
+	}
+}
+
+func (w *webhook) expiringIn() time.Duration {
+	if w.config.ExpiringIn == 0 {
+		return DefaultWebhookExpiringIn
+	}
+
+	return w.config.ExpiringIn
+}
+
+func (w *webhook) wants(event string) bool {
+	if len(w.config.Events) == 0 {
+		return true
+	}
+
+	for _, e := range w.config.Events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// send queues the event for entry, without waiting for the target
+func (w *webhook) send(event string, name string, entry Entry) {
+	if event == "" || !w.wants(event) {
+		return
+	}
+
+	payload := WebhookPayload{
+		Event:     event,
+		Name:      name,
+		Addresses: entry.IPs(),
+		Expires:   entry.Expires.Format(time.RFC3339),
+		Time:      time.Now().Format(time.RFC3339),
+	}
+
+	select {
+	case w.queue <- payload:
+	default:
+		log.Printf("Webhook queue of %s is full, dropping %s event for %s\n", w.config.URL, event, name)
+	}
+}
+
+// sign returns the signature header of body
+func (w *webhook) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.config.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver makes one attempt at sending body, reporting whether a failed attempt should be retried
+func (w *webhook) deliver(ctx context.Context, event string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event", event)
+	if w.config.Secret != "" {
+		req.Header.Set("X-Signature", w.sign(body))
+	}
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = fmt.Errorf("webhook %s replied with %s", w.config.URL, res.Status)
+	return res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests, err
+}
+
+// post sends payload, retrying with backoff
+func (w *webhook) post(ctx context.Context, payload WebhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		sentry.CaptureException(err)
+		return
+	}
+
+	retries := w.config.Retries
+	if retries == 0 {
+		retries = DefaultWebhookRetries
+	} else if retries < 0 {
+		retries = 0
+	}
+	delay := w.config.RetryDelay
+	if delay == 0 {
+		delay = DefaultWebhookRetryDelay
+	}
+
+	for try := 0; ; try++ {
+		retry, err := w.deliver(ctx, payload.Event, body)
+		if err == nil {
+			return
+		}
+
+		if !retry || try >= retries || ctx.Err() != nil {
+			sentry.CaptureException(err)
+			log.Printf("Failed to send %s webhook for %s: %s\n", payload.Event, payload.Name, err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (w *webhook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case payload := <-w.queue:
+			w.post(ctx, payload)
+		}
+	}
+}
+
+// webhookEvent returns the webhook event of a store event
+func webhookEvent(event Event) string {
+	switch event.Type {
+	case EventAdded:
+		return WebhookRegistered
+	case EventChanged:
+		if event.Reason == ReasonRenewed {
+			return WebhookRenewed
+		}
+		if event.Reason == ReasonKeyIssued || event.Reason == ReasonChallenge { // the addresses didn't change
+			return ""
+		}
+
+		return WebhookUpdated
+	case EventRemoved:
+		switch event.Reason {
+		case ReasonExpired:
+			return WebhookExpired
+		case ReasonRenamed:
+			return WebhookRenamed
+		case ReasonAddressTaken:
+			return WebhookAddressTaken
+		}
+
+		return WebhookReleased
+	}
+
+	return ""
+}
+
+// scanExpiring sends the expiring event for the entries expiring soon, once per expiry
+func scanExpiring(store *Store, hooks []*webhook) error {
+	now := time.Now()
+	seen := make(map[string]bool)
+
+	err := store.ForEach(func(name string, entry Entry) error {
+		seen[name] = true
+		for _, hook := range hooks {
+			if hook.notified[name].Equal(entry.Expires) || entry.Expires.Sub(now) > hook.expiringIn() {
+				continue
+			}
+
+			hook.notified[name] = entry.Expires
+			hook.send(WebhookExpiring, name, entry)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		for name := range hook.notified {
+			if !seen[name] {
+				delete(hook.notified, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func ProvideWebhooks(configs []WebhookConfig, store *Store, ctx context.Context, errChan chan<- error) {
+	if len(configs) == 0 {
+		return
+	}
+
+	// the primary sends the events of replicas, which would repeat them for every replicated change
+	if store.primary != nil {
+		log.Printf("Not sending webhooks from a replica, the primary sends them\n")
+		return
+	}
+
+	var hooks []*webhook
+	for i := range configs {
+		hook := newWebhook(&configs[i])
+		hooks = append(hooks, hook)
+		go hook.run(ctx)
+	}
+
+	unsubscribe := store.Subscribe(func(event Event) {
+		for _, hook := range hooks {
+			hook.send(webhookEvent(event), event.Name, event.Entry)
+		}
+	})
+
+	go func() {
+		defer unsubscribe()
+
+		ticker := time.NewTicker(store.SweepInterval())
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := scanExpiring(store, hooks)
+				if err != nil && !errors.Is(err, ErrNotOpen) {
+					sentry.CaptureException(err)
+					log.Printf("Failed to check for expiring entries: %s\n", err)
+				}
+			}
+		}
+	}()
+
+	log.Printf("Sending webhooks to %d targets\n", len(hooks))
+}
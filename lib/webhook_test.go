@@ -0,0 +1,88 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhooks(t *testing.T) {
+	store := testStore(t, &StoreConfig{
+		TTL:           300 * time.Millisecond,
+		SweepInterval: 50 * time.Millisecond,
+	})
+
+	config := []WebhookConfig{{
+		Secret:     "secret",
+		ExpiringIn: 200 * time.Millisecond,
+		RetryDelay: 10 * time.Millisecond,
+	}}
+	hook := newWebhook(&config[0])
+
+	payloads := make(chan WebhookPayload, 10)
+	failed := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, err := io.ReadAll(request.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, hook.sign(body), request.Header.Get("X-Signature"))
+
+		// the first request is retried
+		if !failed {
+			failed = true
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var payload WebhookPayload
+		assert.NoError(t, json.Unmarshal(body, &payload))
+		assert.Equal(t, payload.Event, request.Header.Get("X-Event"))
+		payloads <- payload
+	}))
+	defer receiver.Close()
+	config[0].URL = receiver.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ProvideWebhooks(config, store, ctx, nil)
+
+	ip := net.ParseIP("2001:db8::1")
+	_, name, err := store.AddEntry(Auth{IP: ip}, "")
+	assert.NoError(t, err)
+
+	for _, event := range []string{WebhookRegistered, WebhookExpiring, WebhookExpired} {
+		select {
+		case payload := <-payloads:
+			assert.Equal(t, event, payload.Event)
+			assert.Equal(t, name, payload.Name)
+			assert.Equal(t, []net.IP{ip}, payload.Addresses)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no %s webhook received", event)
+		}
+	}
+}
+
+func TestWebhookNoRetries(t *testing.T) {
+	requests := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		requests++
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	hook := newWebhook(&WebhookConfig{URL: receiver.URL, Retries: -1, RetryDelay: time.Millisecond})
+	hook.post(context.Background(), WebhookPayload{Event: WebhookRegistered})
+	assert.Equal(t, 1, requests)
+}
+
+func TestWebhookEvent(t *testing.T) {
+	assert.Equal(t, WebhookReleased, webhookEvent(Event{Type: EventRemoved, Reason: ReasonReleased}))
+	assert.Equal(t, WebhookRenamed, webhookEvent(Event{Type: EventRemoved, Reason: ReasonRenamed}))
+	assert.Equal(t, WebhookAddressTaken, webhookEvent(Event{Type: EventRemoved, Reason: ReasonAddressTaken}))
+	assert.Equal(t, WebhookUpdated, webhookEvent(Event{Type: EventChanged, Reason: ReasonAddressTaken}))
+}
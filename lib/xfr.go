@@ -0,0 +1,188 @@
+package lib
+
+import (
+	"errors"
+	"github.com/getsentry/sentry-go"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// transferChunk is the number of records sent in each message of a transfer
+const transferChunk = 256
+
+var ErrTransferKeyName = errors.New("dns.transfer.tsig_keys can't be named within the zone, where the keys of the entries are")
+
+type zoneTransfer struct {
+	allow []*net.IPNet
+	keys  map[string]string
+}
+
+func newZoneTransfer(config *TransferConfig, domain string) (*zoneTransfer, error) {
+	t := &zoneTransfer{
+		keys: tsigSecrets(config),
+	}
+
+	for name := range t.keys {
+		if dns.IsSubDomain(domain+".", name) {
+			return nil, ErrTransferKeyName
+		}
+	}
+
+	for _, allow := range config.Allow {
+		prefix, err := parsePrefix(allow)
+		if err != nil {
+			return nil, err
+		}
+		t.allow = append(t.allow, prefix)
+	}
+
+	return t, nil
+}
+
+// tsigSecrets returns the TSIG keys with fully qualified names, as the server expects them
+func tsigSecrets(config *TransferConfig) map[string]string {
+	secrets := make(map[string]string)
+	for name, secret := range config.TSIGKeys {
+		secrets[dns.Fqdn(strings.ToLower(name))] = secret
+	}
+
+	return secrets
+}
+
+// allowed returns the rcode to reply with if the client may not transfer the zone, or RcodeSuccess if it may
+func (t *zoneTransfer) allowed(w dns.ResponseWriter, r *dns.Msg) int {
+	ip := remoteIP(w)
+
+	permitted := false
+	for _, prefix := range t.allow {
+		if prefix.Contains(ip) {
+			permitted = true
+			break
+		}
+	}
+	if !permitted {
+		return dns.RcodeRefused
+	}
+
+	tsig := r.IsTsig()
+	if tsig == nil {
+		if len(t.keys) > 0 {
+			return dns.RcodeRefused
+		}
+
+		return dns.RcodeSuccess
+	}
+	if w.TsigStatus() != nil {
+		return dns.RcodeNotAuth
+	}
+	if _, ok := t.keys[strings.ToLower(tsig.Hdr.Name)]; !ok { // the keys of the entries only allow updates
+		return dns.RcodeRefused
+	}
+
+	return dns.RcodeSuccess
+}
+
+// signReply signs m with the key of r, if r was signed with a valid one
+func signReply(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) {
+	if tsig := r.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+}
+
+// isTransfer returns whether r asks for a zone transfer
+func isTransfer(r *dns.Msg) bool {
+	return r.Opcode == dns.OpcodeQuery && len(r.Question) == 1 &&
+		(r.Question[0].Qtype == dns.TypeAXFR || r.Question[0].Qtype == dns.TypeIXFR)
+}
+
+// handleTransfer answers AXFR and IXFR queries for the zone.
+// There is no journal of the changes, so IXFR is answered with the full zone unless the client is up-to-date (RFC 1995 section 4).
+func handleTransfer(w dns.ResponseWriter, r *dns.Msg, store *Store, config *DNSConfig, t *zoneTransfer) {
+	q := r.Question[0]
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	reply := func() {
+		signReply(w, r, m)
+
+		err := w.WriteMsg(m)
+		if err != nil {
+			log.Printf("RESPONSE WRITING ERROR: %s", err)
+		}
+	}
+
+	if strings.ToLower(q.Name) != store.Domain()+"." {
+		m.Rcode = dns.RcodeNotAuth
+		reply()
+		return
+	}
+
+	if rcode := t.allowed(w, r); rcode != dns.RcodeSuccess {
+		log.Printf("Refused transfer to %s", w.RemoteAddr())
+		m.Rcode = rcode
+		reply()
+		return
+	}
+
+	rrs, err := ZoneRRs(config, store)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Printf("Failed to get zone: %s", err)
+		m.Rcode = dns.RcodeServerFailure
+		reply()
+		return
+	}
+	soa := rrs[0].(*dns.SOA)
+
+	_, udp := w.RemoteAddr().(*net.UDPAddr)
+	if q.Qtype == dns.TypeIXFR || udp {
+		upToDate := false
+		if q.Qtype == dns.TypeIXFR && len(r.Ns) > 0 {
+			if current, ok := r.Ns[0].(*dns.SOA); ok {
+				upToDate = SerialCompare(current.Serial, soa.Serial) >= 0
+			}
+		}
+
+		// only the SOA fits into UDP, which tells the client to retry over TCP
+		if upToDate || udp {
+			m.Answer = []dns.RR{soa}
+			reply()
+			return
+		}
+	}
+
+	log.Printf("Transfer of %d records to %s", len(rrs), w.RemoteAddr())
+
+	// sent like dns.Transfer.Out does, which leaves the sender blocked after a failed write
+	rrs = append(rrs, soa)
+	for len(rrs) > 0 {
+		n := len(rrs)
+		if n > transferChunk {
+			n = transferChunk
+		}
+
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = rrs[:n]
+		rrs = rrs[n:]
+		signReply(w, r, m)
+
+		err := w.WriteMsg(m)
+		if err != nil {
+			log.Printf("Transfer to %s failed: %s", w.RemoteAddr(), err)
+			break
+		}
+		w.TsigTimersOnly(true)
+	}
+
+	err = w.Close()
+	if err != nil {
+		log.Printf("Failed to close transfer connection: %s", err)
+	}
+}
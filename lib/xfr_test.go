@@ -0,0 +1,17 @@
+package lib
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestZoneTransferKeyNames(t *testing.T) {
+	_, err := newZoneTransfer(&TransferConfig{TSIGKeys: map[string]string{"xfr": "c2VjcmV0"}}, "give-me-dns.net")
+	assert.NoError(t, err)
+
+	// keys within the zone would be confused with those of the entries
+	for _, name := range []string{"give-me-dns.net", "abcde.give-me-dns.net.", "ABCDE.Give-Me-DNS.net"} {
+		_, err = newZoneTransfer(&TransferConfig{TSIGKeys: map[string]string{name: "c2VjcmV0"}}, "give-me-dns.net")
+		assert.ErrorIs(t, err, ErrTransferKeyName, name)
+	}
+}